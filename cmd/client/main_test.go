@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/gamelogic"
+	"github.com/hyuko21/pubsub-golang/internal/pubsub"
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+)
+
+const flowTimeout = 5 * time.Second
+
+type testPlayer struct {
+	state  *gamelogic.GameState
+	pub    *pubsub.Publisher
+	outbox *pubsub.Outbox
+}
+
+func newTestPlayer(t *testing.T, ctx context.Context, conn pubsub.Broker, username string) *testPlayer {
+	t.Helper()
+	pub := pubsub.NewPublisher(conn, pubsub.WithSender(username))
+	t.Cleanup(func() { pub.Close() })
+	outbox, err := pubsub.OpenOutbox(filepath.Join(t.TempDir(), username+".jsonl"), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	state := gamelogic.NewGameState(username)
+	subs := []*pubsub.Subscription{
+		subscribeToPause(ctx, conn, state, username),
+		subscribeToArmyMoves(ctx, conn, pub, state, username),
+		subscribeToWarRecognitions(ctx, conn, pub, state),
+	}
+	t.Cleanup(func() { closeSubscriptions(subs) })
+	return &testPlayer{state: state, pub: pub, outbox: outbox}
+}
+
+// isPaused probes the pause state with a move that is invalid either way,
+// so that it does not move any units.
+func (p *testPlayer) isPaused() bool {
+	_, err := p.state.CommandMove([]string{"move", "nowhere", "1"})
+	return strings.Contains(err.Error(), "paused")
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(flowTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGameFlow plays a pause, a move into an occupied location, the war it
+// starts and the game log reporting it through an in-memory broker.
+func TestGameFlow(t *testing.T) {
+	playGameFlow(t, publishMove)
+}
+
+// TestGameFlowWithJSONMoves plays the game flow with a move published as
+// JSON, like clients from before moves were encoded with MessagePack do.
+func TestGameFlowWithJSONMoves(t *testing.T) {
+	playGameFlow(t, func(outbox *pubsub.Outbox, username string, move gamelogic.ArmyMove) error {
+		routingKey := fmt.Sprintf("%s.%s", routing.ArmyMovesPrefix, username)
+		return outbox.Publish(pubsub.JSON, routing.ExchangePerilTopic, routingKey, move)
+	})
+}
+
+func playGameFlow(t *testing.T, publishMove func(*pubsub.Outbox, string, gamelogic.ArmyMove) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pubsub.NewMemoryBroker()
+	defer conn.Close()
+	if err := pubsub.DeclareExchanges(ctx, conn, pubsub.PerilExchanges...); err != nil {
+		t.Fatal(err)
+	}
+	if err := pubsub.DeclareDeadLetterTopology(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	gameLogs := make(chan routing.GameLog, 10)
+	logsSub, err := pubsub.Subscribe(ctx, conn, pubsub.JSON, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", pubsub.DurableQueue,
+		func(gamelog routing.GameLog, _ pubsub.Envelope) pubsub.AckType {
+			gameLogs <- gamelog
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logsSub.Close()
+
+	alice := newTestPlayer(t, ctx, conn, "alice")
+	bob := newTestPlayer(t, ctx, conn, "bob")
+	server := pubsub.NewPublisher(conn, pubsub.WithSender("server"))
+	defer server.Close()
+
+	for _, paused := range []bool{true, false} {
+		err := server.PublishConfirmed(ctx, pubsub.JSON, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{IsPaused: paused})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, fmt.Sprintf("both players to see paused=%v", paused), func() bool {
+			return alice.isPaused() == paused && bob.isPaused() == paused
+		})
+	}
+
+	if err := alice.state.CommandSpawn([]string{"spawn", "asia", gamelogic.RankInfantry}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.state.CommandSpawn([]string{"spawn", "europe", gamelogic.RankInfantry}); err != nil {
+		t.Fatal(err)
+	}
+	move, err := alice.state.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publishMove(alice.outbox, "alice", move); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case gamelog := <-gameLogs:
+		want := "A war between alice and bob resulted in a draw"
+		if gamelog.Username != "alice" || gamelog.Message != want {
+			t.Errorf("got game log %q from %s, want %q from alice", gamelog.Message, gamelog.Username, want)
+		}
+	case <-time.After(flowTimeout):
+		t.Fatal("timed out waiting for the game log of the war")
+	}
+	if units := alice.state.GetPlayerSnap().Units; len(units) != 0 {
+		t.Errorf("alice has %d units left after a draw, want 0", len(units))
+	}
+}
+
+// TestMoveUndoneWhenNotQueued moves a unit while the outbox cannot record
+// the move, which must leave the unit where it was.
+func TestMoveUndoneWhenNotQueued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn := pubsub.NewMemoryBroker()
+	defer conn.Close()
+	if err := pubsub.DeclareExchanges(ctx, conn, pubsub.PerilExchanges...); err != nil {
+		t.Fatal(err)
+	}
+	alice := newTestPlayer(t, ctx, conn, "alice")
+	if err := alice.state.CommandSpawn([]string{"spawn", "asia", gamelogic.RankInfantry}); err != nil {
+		t.Fatal(err)
+	}
+	alice.outbox.Close()
+	if err := commandMove(alice.state, alice.outbox, "alice", []string{"move", "europe", "1"}); err == nil {
+		t.Fatal("move was accepted with a closed outbox")
+	}
+	if unit, _ := alice.state.GetUnit(1); unit.Location != "asia" {
+		t.Errorf("unit is in %s after an undone move, want asia", unit.Location)
+	}
+}
@@ -1,6 +1,7 @@
 package gamelogic
 
 import (
+	"log/slog"
 	"sync"
 )
 
@@ -8,10 +9,11 @@ type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	logger *slog.Logger
 }
 
 func NewGameState(username string) *GameState {
-	return &GameState{
+	gs := &GameState{
 		Player: Player{
 			Username: username,
 			Units:    map[int]Unit{},
@@ -19,6 +21,14 @@ func NewGameState(username string) *GameState {
 		Paused: false,
 		mu:     &sync.RWMutex{},
 	}
+	gs.SetLogger(slog.Default())
+	return gs
+}
+
+// SetLogger makes the game state report game events to l, tagged with the
+// player's username.
+func (gs *GameState) SetLogger(l *slog.Logger) {
+	gs.logger = l.With("username", gs.Player.Username)
 }
 
 func (gs *GameState) resumeGame() {
@@ -15,15 +15,14 @@ const (
 )
 
 func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
-	defer fmt.Println("------------------------")
 	player := gs.GetPlayerSnap()
 
-	fmt.Println()
-	fmt.Println("==== Move Detected ====")
-	fmt.Printf("%s is moving %v unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+	ranks := make([]UnitRank, 0, len(move.Units))
 	for _, unit := range move.Units {
-		fmt.Printf("* %v\n", unit.Rank)
+		ranks = append(ranks, unit.Rank)
 	}
+	logger := gs.logger.With("mover", move.Player.Username)
+	logger.Info("move detected", "location", move.ToLocation, "ranks", ranks)
 
 	if player.Username == move.Player.Username {
 		return MoveOutcomeSamePlayer
@@ -31,10 +30,10 @@ func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
 
 	overlappingLocation := getOverlappingLocation(player, move.Player)
 	if overlappingLocation != "" {
-		fmt.Printf("You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
+		logger.Warn("at war", "location", overlappingLocation)
 		return MoveOutcomeMakeWar
 	}
-	fmt.Printf("You are safe from %s's units.\n", move.Player.Username)
+	logger.Info("safe from move")
 	return MoveOutComeSafe
 }
 
@@ -87,6 +86,6 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		Units:      newUnits,
 		Player:     gs.GetPlayerSnap(),
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
+	gs.logger.Info("units moved", "units", len(mv.Units), "location", mv.ToLocation)
 	return mv, nil
 }
@@ -1,19 +1,15 @@
 package gamelogic
 
 import (
-	"fmt"
-
 	"github.com/hyuko21/pubsub-golang/internal/routing"
 )
 
 func (gs *GameState) HandlePause(ps routing.PlayingState) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
 	if ps.IsPaused {
-		fmt.Println("==== Pause Detected ====")
+		gs.logger.Info("game paused")
 		gs.pauseGame()
 	} else {
-		fmt.Println("==== Resume Detected ====")
+		gs.logger.Info("game resumed")
 		gs.resumeGame()
 	}
 }
@@ -0,0 +1,8 @@
+package gamelogic
+
+import "github.com/hyuko21/pubsub-golang/internal/routing"
+
+func init() {
+	routing.RegisterSchema[ArmyMove](1)
+	routing.RegisterSchema[RecognitionOfWar](1)
+}
@@ -29,6 +29,6 @@ func (gs *GameState) CommandSpawn(words []string) error {
 		Location: Location(locationName),
 	})
 
-	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
+	gs.logger.Info("unit spawned", "unit_id", id, "rank", rank, "location", locationName)
 	return nil
 }
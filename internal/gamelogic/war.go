@@ -1,9 +1,5 @@
 package gamelogic
 
-import (
-	"fmt"
-)
-
 type WarOutcome int
 
 const (
@@ -15,28 +11,27 @@ const (
 )
 
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
-	fmt.Println("==== War Declared ====")
-	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
+	logger := gs.logger.With("attacker", rw.Attacker.Username, "defender", rw.Defender.Username)
+	logger.Info("war declared")
 
 	player := gs.GetPlayerSnap()
 
 	if player.Username == rw.Defender.Username {
-		fmt.Printf("%s, you published the war.\n", player.Username)
+		logger.Info("not fighting a war this player published")
 		return WarOutcomeNotInvolved, "", ""
 	}
 
 	if player.Username != rw.Attacker.Username {
-		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
+		logger.Info("not involved in war")
 		return WarOutcomeNotInvolved, "", ""
 	}
 
 	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
 	if overlappingLocation == "" {
-		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
+		logger.Error("no units in the same location, no war will be fought")
 		return WarOutcomeNoUnits, "", ""
 	}
+	logger = logger.With("location", overlappingLocation)
 
 	attackerUnits := []Unit{}
 	defenderUnits := []Unit{}
@@ -51,40 +46,28 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 		}
 	}
 
-	fmt.Printf("%s's units:\n", rw.Attacker.Username)
-	for _, unit := range attackerUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
-	}
-	fmt.Printf("%s's units:\n", rw.Defender.Username)
-	for _, unit := range defenderUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
-	}
 	attackerPower := unitsToPowerLevel(attackerUnits)
 	defenderPower := unitsToPowerLevel(defenderUnits)
-	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
-	fmt.Printf("Defender has a power level of %v\n", defenderPower)
+	logger = logger.With("attacker_power", attackerPower, "defender_power", defenderPower)
 	if attackerPower > defenderPower {
-		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
+		logger.Info("war won", "winner", rw.Attacker.Username)
 		if player.Username == rw.Defender.Username {
-			fmt.Println("You have lost the war!")
 			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
+			logger.Warn("war lost, units killed")
 			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
 		}
 		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
 	} else if defenderPower > attackerPower {
-		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
+		logger.Info("war won", "winner", rw.Defender.Username)
 		if player.Username == rw.Attacker.Username {
-			fmt.Println("You have lost the war!")
 			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
+			logger.Warn("war lost, units killed")
 			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
 		}
 		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
 	}
-	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
 	gs.removeUnitsInLocation(overlappingLocation)
+	logger.Warn("war ended in a draw, units killed")
 	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
 }
 
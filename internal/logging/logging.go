@@ -0,0 +1,42 @@
+// Package logging configures the slog logger of the Peril binaries.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger that writes records at or above level to w, as
+// key=value text or as JSON objects depending on format.
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s'", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s', want '%s' or '%s'", format, FormatText, FormatJSON)
+}
+
+// Setup makes a logger writing to stderr the default for both log/slog and
+// the log package.
+func Setup(format, level string) (*slog.Logger, error) {
+	logger, err := New(os.Stderr, format, level)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
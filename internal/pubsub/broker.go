@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker is what the rest of the package programs against. Connection
+// implements it on top of RabbitMQ and MemoryBroker in-process.
+type Broker interface {
+	// Channel opens a channel, blocking while the broker is unreachable
+	// until it is back or ctx is done. Once the broker has been closed it
+	// returns ErrConnectionClosed.
+	Channel(ctx context.Context) (Channel, error)
+	Close() error
+}
+
+// Channel is the subset of *amqp.Channel used by the package.
+type Channel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Confirm(noWait bool) error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	// PublishWithConfirm publishes on a channel in confirm mode and returns
+	// a handle to wait for the broker's ack or nack.
+	PublishWithConfirm(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (Confirmation, error)
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	IsClosed() bool
+	Close() error
+}
+
+type Confirmation interface {
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+var errNotInConfirmMode = errors.New("channel is not in confirm mode")
+
+type amqpChannel struct {
+	*amqp.Channel
+}
+
+func (ch amqpChannel) PublishWithConfirm(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (Confirmation, error) {
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return nil, err
+	}
+	if confirmation == nil {
+		return nil, errNotInConfirmMode
+	}
+	return confirmation, nil
+}
+
+// topologyRecorder is implemented by brokers that lose their topology when
+// they reconnect and need declarations replayed.
+type topologyRecorder interface {
+	remember(key string, declare func(Channel) error)
+}
+
+func remember(b Broker, key string, declare func(Channel) error) {
+	if r, ok := b.(topologyRecorder); ok {
+		r.remember(key, declare)
+	}
+}
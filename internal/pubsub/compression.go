@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+)
+
+// String returns the content encoding that marks a body compressed with c.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return ""
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(c))
+}
+
+// maxDecompressedSize bounds how large a body may grow when decompressed, so
+// a small malicious message cannot exhaust memory.
+const maxDecompressedSize = 64 << 20
+
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+)
+
+// WithCompression compresses message bodies of at least threshold bytes and
+// sets their content encoding accordingly. Subscribers decompress them
+// before decoding.
+func WithCompression(c Compression, threshold int) PublisherOption {
+	return func(p *Publisher) {
+		p.compression = c
+		p.compressionThreshold = threshold
+	}
+}
+
+func compress(msg *amqp.Publishing, c Compression, threshold int) error {
+	if c == NoCompression || msg.ContentEncoding != "" || len(msg.Body) < threshold {
+		return nil
+	}
+	var body []byte
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(msg.Body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	case Zstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return err
+		}
+		body = enc.EncodeAll(msg.Body, nil)
+	default:
+		return fmt.Errorf("unknown compression %s", c)
+	}
+	msg.Body = body
+	msg.ContentEncoding = c.String()
+	return nil
+}
+
+// decompress returns body decoded according to its content encoding.
+func decompress(contentEncoding string, body []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return body, nil
+	case Gzip.String():
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxDecompressedSize {
+			return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxDecompressedSize)
+		}
+		return data, nil
+	case Zstd.String():
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(body, nil)
+	}
+	return nil, fmt.Errorf("unsupported content encoding '%s'", contentEncoding)
+}
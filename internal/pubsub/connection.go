@@ -0,0 +1,187 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+var ErrConnectionClosed = errors.New("connection closed")
+
+// Connection wraps an AMQP connection that is redialed whenever the broker
+// drops it. Queues and bindings declared through it are redeclared on every
+// reconnect, before any waiting Channel call returns.
+type Connection struct {
+	url string
+
+	mu          sync.Mutex
+	conn        *amqp.Connection
+	reconnected chan struct{}
+
+	topologyMu   sync.Mutex
+	topology     map[string]func(Channel) error
+	topologyKeys []string
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func Dial(url string) (*Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	c := &Connection{
+		url:         url,
+		reconnected: make(chan struct{}),
+		topology:    map[string]func(Channel) error{},
+		closed:      make(chan struct{}),
+	}
+	c.setConn(conn)
+	go c.watch(conn)
+	return c, nil
+}
+
+// Channel opens a channel on the current connection. While the connection is
+// being re-established it blocks until it is back, ctx is done or c is closed.
+func (c *Connection) Channel(ctx context.Context) (Channel, error) {
+	for {
+		c.mu.Lock()
+		conn, reconnected := c.conn, c.reconnected
+		c.mu.Unlock()
+		if conn != nil && !conn.IsClosed() {
+			ch, err := conn.Channel()
+			if err == nil {
+				return amqpChannel{ch}, nil
+			}
+			if !conn.IsClosed() {
+				return nil, err
+			}
+		}
+		select {
+		case <-reconnected:
+		case <-c.closed:
+			return nil, ErrConnectionClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Connection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	return err
+}
+
+func (c *Connection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// remember records a declaration so it can be replayed after a reconnect.
+// Declarations sharing a key replace each other.
+func (c *Connection) remember(key string, declare func(Channel) error) {
+	c.topologyMu.Lock()
+	defer c.topologyMu.Unlock()
+	if _, ok := c.topology[key]; !ok {
+		c.topologyKeys = append(c.topologyKeys, key)
+	}
+	c.topology[key] = declare
+}
+
+func (c *Connection) redeclare(conn *amqp.Connection) error {
+	c.topologyMu.Lock()
+	defer c.topologyMu.Unlock()
+	for _, key := range c.topologyKeys {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		if err := c.topology[key](amqpChannel{ch}); err != nil {
+			logger().Error("error redeclaring topology", "topology", key, "error", err)
+		}
+		ch.Close()
+	}
+	return nil
+}
+
+// setConn makes conn the current connection and wakes up blocked Channel
+// calls. It reports false if c was closed in the meantime.
+func (c *Connection) setConn(conn *amqp.Connection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.conn = conn
+	close(c.reconnected)
+	c.reconnected = make(chan struct{})
+	return true
+}
+
+func (c *Connection) watch(conn *amqp.Connection) {
+	for {
+		closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+		var amqpErr *amqp.Error
+		select {
+		case <-c.closed:
+			return
+		case amqpErr = <-closeCh:
+		}
+		if c.isClosed() {
+			return
+		}
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		logger().Warn("lost connection to Rabbitmq server", "error", amqpErr)
+		if conn = c.redial(); conn == nil {
+			return
+		}
+		logger().Info("reconnected to Rabbitmq server")
+	}
+}
+
+func (c *Connection) redial() *amqp.Connection {
+	backoff := minReconnectBackoff
+	for {
+		select {
+		case <-c.closed:
+			return nil
+		case <-time.After(backoff):
+		}
+		conn, err := amqp.Dial(c.url)
+		if err == nil {
+			if err = c.redeclare(conn); err == nil {
+				if !c.setConn(conn) {
+					conn.Close()
+					return nil
+				}
+				return conn
+			}
+			conn.Close()
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+		logger().Warn("error reconnecting to Rabbitmq server", "retry_in", backoff, "error", err)
+	}
+}
@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultDedupWindow = 10_000
+
+// Deduplicator remembers the IDs of the last messages handled on each queue
+// so that redeliveries of them can be acked without running the handler
+// again. One Deduplicator can be shared by several subscriptions.
+//
+// A message counts as handled once its handler returns Ack or NackDiscard. A
+// NackRequeue forgets the message, so that its redelivery is handled. While
+// a message is being handled, other deliveries of it are treated as
+// duplicates.
+type Deduplicator struct {
+	mu       sync.Mutex
+	window   int
+	handled  map[string]bool
+	order    []string
+	store    *os.File
+	appended int
+
+	suppressed atomic.Uint64
+}
+
+// NewDeduplicator remembers up to window message IDs in memory, or a
+// default number of them if window is not positive.
+func NewDeduplicator(window int) *Deduplicator {
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	return &Deduplicator{
+		window:  window,
+		handled: map[string]bool{},
+	}
+}
+
+// OpenDeduplicator is like NewDeduplicator, but also records handled message
+// IDs in the file at path so that they are remembered across restarts.
+func OpenDeduplicator(path string, window int) (*Deduplicator, error) {
+	d := NewDeduplicator(window)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open dedup store: %w", err)
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := scanner.Text(); id != "" && !d.handled[id] {
+			d.remember(id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not read dedup store: %w", err)
+	}
+	d.store = f
+	if err := d.compact(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Suppressed returns how many duplicate deliveries have been skipped.
+func (d *Deduplicator) Suppressed() uint64 {
+	return d.suppressed.Load()
+}
+
+func (d *Deduplicator) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.store == nil {
+		return nil
+	}
+	err := d.store.Close()
+	d.store = nil
+	return err
+}
+
+// reserve claims id for handling and reports false if it has already been
+// handled or is being handled.
+func (d *Deduplicator) reserve(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.handled[id]; ok {
+		d.suppressed.Add(1)
+		return false
+	}
+	d.handled[id] = false
+	return true
+}
+
+// settle records the outcome of handling a reserved id.
+func (d *Deduplicator) settle(id string, ack AckType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.handled, id)
+	if ack == NackRequeue {
+		return
+	}
+	d.remember(id)
+	if d.store == nil {
+		return
+	}
+	if _, err := fmt.Fprintln(d.store, id); err != nil {
+		logger().Error("error recording message in dedup store", "dedup_key", id, "error", err)
+		return
+	}
+	d.appended++
+	if d.appended >= d.window {
+		if err := d.compact(); err != nil {
+			logger().Error("error compacting dedup store", "error", err)
+		}
+	}
+}
+
+func (d *Deduplicator) remember(id string) {
+	d.handled[id] = true
+	d.order = append(d.order, id)
+	if len(d.order) > d.window {
+		delete(d.handled, d.order[0])
+		d.order = d.order[1:]
+	}
+}
+
+// compact rewrites the store with only the IDs still in the window.
+func (d *Deduplicator) compact() error {
+	if err := d.store.Truncate(0); err != nil {
+		return fmt.Errorf("could not compact dedup store: %w", err)
+	}
+	if _, err := d.store.Seek(0, 0); err != nil {
+		return fmt.Errorf("could not compact dedup store: %w", err)
+	}
+	w := bufio.NewWriter(d.store)
+	for _, id := range d.order {
+		fmt.Fprintln(w, id)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not compact dedup store: %w", err)
+	}
+	d.appended = 0
+	return nil
+}
+
+// WithDeduplication skips and acks deliveries whose message ID d has
+// already seen on this queue. Messages without an ID are always handled.
+func WithDeduplication(d *Deduplicator) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.dedup = d
+	}
+}
@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	"go.opentelemetry.io/otel"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const appID = "peril"
+
+const (
+	HeaderSender        = "x-sender"
+	HeaderCausationID   = "x-causation-id"
+	HeaderSchemaVersion = "x-schema-version"
+)
+
+// Envelope is the metadata that travels with every message. The correlation
+// ID is shared by every message in a causal chain and defaults to the ID of
+// the message that started it; the causation ID is the ID of the message
+// that directly caused this one.
+type Envelope struct {
+	MessageID     string
+	PublishedAt   time.Time
+	Sender        string
+	CorrelationID string
+	CausationID   string
+	ReplyTo       string
+	Exchange      string
+	RoutingKey    string
+	Redelivered   bool
+	Headers       amqp.Table
+
+	ctx context.Context
+}
+
+// Context returns the context the message is handled in, which carries the
+// span of the handler. It is context.Background for envelopes that were not
+// built from a delivery.
+func (e Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+type Handler[T any] func(T, Envelope) AckType
+
+type PublishOption func(*amqp.Publishing)
+
+func WithCorrelationID(id string) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.CorrelationId = id
+	}
+}
+
+// CausedBy marks the message as a consequence of the one env describes, so
+// it joins env's correlation chain and its trace.
+func CausedBy(env Envelope) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.CorrelationId = env.CorrelationID
+		if msg.CorrelationId == "" {
+			msg.CorrelationId = env.MessageID
+		}
+		msg.Headers[HeaderCausationID] = env.MessageID
+		otel.GetTextMapPropagator().Inject(env.Context(), headerCarrier(msg.Headers))
+	}
+}
+
+func WithHeader(key string, value any) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.Headers[key] = value
+	}
+}
+
+func newPublishing(codec Codec, val any, sender string, opts []PublishOption) (amqp.Publishing, error) {
+	body, err := codec.Marshal(val)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	msg := amqp.Publishing{
+		Headers:     amqp.Table{},
+		ContentType: codec.ContentType(),
+		MessageId:   newMessageID(),
+		Timestamp:   time.Now(),
+		AppId:       appID,
+		Body:        body,
+	}
+	if sender != "" {
+		msg.Headers[HeaderSender] = sender
+	}
+	if version, ok := routing.SchemaVersion(val); ok {
+		msg.Headers[HeaderSchemaVersion] = int32(version)
+	}
+	for _, opt := range opts {
+		opt(&msg)
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = msg.MessageId
+	}
+	return msg, nil
+}
+
+func envelopeFromDelivery(ctx context.Context, msg amqp.Delivery) Envelope {
+	sender, _ := msg.Headers[HeaderSender].(string)
+	causationID, _ := msg.Headers[HeaderCausationID].(string)
+	return Envelope{
+		MessageID:     msg.MessageId,
+		PublishedAt:   msg.Timestamp,
+		Sender:        sender,
+		CorrelationID: msg.CorrelationId,
+		CausationID:   causationID,
+		ReplyTo:       msg.ReplyTo,
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+		ctx:           ctx,
+	}
+}
+
+// schemaVersion returns the schema version a message was published with.
+// Messages from before versioning carry no header and are version 1.
+func schemaVersion(headers amqp.Table) int {
+	return max(headerInt(headers, HeaderSchemaVersion), 1)
+}
+
+// newMessageID returns a random (version 4) UUID.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,28 @@
+package pubsub
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger used by the package. Subscriptions pick it up
+// when they are created; until it is set, slog.Default is used.
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := packageLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// WithLogger makes the subscription log to l instead of the package logger.
+func WithLogger(l *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.logger = l
+	}
+}
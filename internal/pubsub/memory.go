@@ -0,0 +1,878 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process Broker for tests and offline play. It
+// supports direct, topic and fanout exchanges plus the default exchange,
+// durable and transient queues, prefetch, acks, nacks with or without
+// requeue, dead-lettering, message TTLs, length limits and direct reply-to.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	channels  map[*memChannel]struct{}
+	seq       uint64
+	closed    bool
+}
+
+type memExchange struct {
+	kind     string
+	durable  bool
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name         string
+	durable      bool
+	autoDelete   bool
+	exclusive    bool
+	args         amqp.Table
+	ready        []*memMessage
+	consumers    []*memConsumer
+	next         int
+	hadConsumers bool
+	deleted      bool
+}
+
+type memMessage struct {
+	exchange    string
+	routingKey  string
+	msg         amqp.Publishing
+	redelivered bool
+	expiresAt   time.Time
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		channels:  map[*memChannel]struct{}{},
+	}
+}
+
+func (b *MemoryBroker) Channel(ctx context.Context) (Channel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrConnectionClosed
+	}
+	ch := &memChannel{
+		broker:    b,
+		consumers: map[string]*memConsumer{},
+		unacked:   map[uint64]*memUnacked{},
+	}
+	b.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for ch := range b.channels {
+		ch.closeLocked()
+	}
+	for _, q := range b.queues {
+		if q.exclusive {
+			b.deleteQueueLocked(q)
+		}
+	}
+	return nil
+}
+
+// Restart simulates a broker restart: every channel is closed, and only
+// durable exchanges, durable queues and persistent messages survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.channels {
+		ch.closeLocked()
+	}
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable || q.exclusive {
+			b.deleteQueueLocked(q)
+			continue
+		}
+		q.ready = slices.DeleteFunc(q.ready, func(m *memMessage) bool {
+			return m.msg.DeliveryMode != amqp.Persistent
+		})
+	}
+}
+
+func (b *MemoryBroker) nextID() uint64 {
+	b.seq++
+	return b.seq
+}
+
+func (b *MemoryBroker) deleteQueueLocked(q *memQueue) {
+	q.deleted = true
+	for _, c := range q.consumers {
+		c.ch.stopConsumerLocked(c)
+	}
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		ex.bindings = slices.DeleteFunc(ex.bindings, func(binding memBinding) bool {
+			return binding.queue == q.name
+		})
+	}
+}
+
+// routeLocked enqueues msg on every queue exchange routes key to and returns
+// how many queues that was, and whether any of them rejected msg because it
+// was full.
+func (b *MemoryBroker) routeLocked(exchange, key string, msg amqp.Publishing) (int, bool, error) {
+	var targets []*memQueue
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		ex, ok := b.exchanges[exchange]
+		if !ok {
+			return 0, false, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+		}
+		for _, binding := range ex.bindings {
+			q, ok := b.queues[binding.queue]
+			if !ok || slices.Contains(targets, q) {
+				continue
+			}
+			if ex.kind == amqp.ExchangeFanout ||
+				(ex.kind == amqp.ExchangeDirect && binding.key == key) ||
+				(ex.kind == amqp.ExchangeTopic && topicMatch(binding.key, key)) {
+				targets = append(targets, q)
+			}
+		}
+	}
+	rejected := false
+	for _, q := range targets {
+		if !b.enqueueLocked(q, exchange, key, msg) {
+			rejected = true
+		}
+	}
+	return len(targets), rejected, nil
+}
+
+// enqueueLocked appends msg to q and reports false if q rejected it instead.
+func (b *MemoryBroker) enqueueLocked(q *memQueue, exchange, key string, msg amqp.Publishing) bool {
+	msg.Headers = copyTable(msg.Headers)
+	m := &memMessage{
+		exchange:   exchange,
+		routingKey: key,
+		msg:        msg,
+	}
+	ttl, hasTTL := time.Duration(0), false
+	if _, ok := q.args["x-message-ttl"]; ok {
+		ttl, hasTTL = time.Duration(headerInt(q.args, "x-message-ttl"))*time.Millisecond, true
+	}
+	if ms, err := strconv.ParseInt(msg.Expiration, 10, 64); err == nil {
+		if !hasTTL || time.Duration(ms)*time.Millisecond < ttl {
+			ttl, hasTTL = time.Duration(ms)*time.Millisecond, true
+		}
+	}
+	if hasTTL {
+		m.expiresAt = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if !q.deleted {
+				b.dispatchLocked(q)
+			}
+		})
+	}
+	if overflow, _ := q.args["x-overflow"].(string); q.fullLocked(m) {
+		switch Overflow(overflow) {
+		case OverflowRejectPublish:
+			return false
+		case OverflowRejectPublishDLX:
+			b.deadLetterLocked(q, m, "maxlen")
+			return false
+		}
+	}
+	q.ready = append(q.ready, m)
+	for len(q.ready) > 0 && q.overLimitLocked() {
+		head := q.ready[0]
+		q.ready = q.ready[1:]
+		b.deadLetterLocked(q, head, "maxlen")
+	}
+	b.dispatchLocked(q)
+	return true
+}
+
+// fullLocked reports whether enqueuing m would take q over its length
+// limits.
+func (q *memQueue) fullLocked(m *memMessage) bool {
+	if _, ok := q.args["x-max-length"]; ok && len(q.ready) >= headerInt(q.args, "x-max-length") {
+		return true
+	}
+	if _, ok := q.args["x-max-length-bytes"]; ok && q.readyBytesLocked()+len(m.msg.Body) > headerInt(q.args, "x-max-length-bytes") {
+		return true
+	}
+	return false
+}
+
+func (q *memQueue) overLimitLocked() bool {
+	if _, ok := q.args["x-max-length"]; ok && len(q.ready) > headerInt(q.args, "x-max-length") {
+		return true
+	}
+	if _, ok := q.args["x-max-length-bytes"]; ok && q.readyBytesLocked() > headerInt(q.args, "x-max-length-bytes") {
+		return true
+	}
+	return false
+}
+
+func (q *memQueue) readyBytesLocked() int {
+	n := 0
+	for _, m := range q.ready {
+		n += len(m.msg.Body)
+	}
+	return n
+}
+
+// dispatchLocked expires stale messages, then hands ready messages to
+// consumers round-robin for as long as one has room under its prefetch.
+func (b *MemoryBroker) dispatchLocked(q *memQueue) {
+	now := time.Now()
+	var expired []*memMessage
+	q.ready = slices.DeleteFunc(q.ready, func(m *memMessage) bool {
+		if !m.expiresAt.IsZero() && !now.Before(m.expiresAt) {
+			expired = append(expired, m)
+			return true
+		}
+		return false
+	})
+	for _, m := range expired {
+		b.deadLetterLocked(q, m, "expired")
+	}
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliverLocked(q, m)
+	}
+}
+
+func (b *MemoryBroker) requeueLocked(q *memQueue, msgs []*memMessage) {
+	if q.deleted || len(msgs) == 0 {
+		return
+	}
+	for _, m := range msgs {
+		m.redelivered = true
+	}
+	q.ready = append(msgs, q.ready...)
+	b.dispatchLocked(q)
+}
+
+// deadLetterLocked republishes m to the queue's dead-letter exchange, if it
+// has one, recording the death in the x-death header like RabbitMQ does.
+func (b *MemoryBroker) deadLetterLocked(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.routingKey
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	msg := m.msg
+	msg.Expiration = ""
+	msg.Headers = copyTable(msg.Headers)
+	msg.Headers["x-death"] = recordDeath(msg.Headers["x-death"], amqp.Table{
+		"queue":        q.name,
+		"reason":       reason,
+		"exchange":     m.exchange,
+		"routing-keys": []interface{}{m.routingKey},
+		"time":         time.Now(),
+	})
+	b.routeLocked(dlx, key, msg)
+}
+
+func recordDeath(header any, death amqp.Table) []interface{} {
+	deaths, _ := header.([]interface{})
+	count := int64(1)
+	rest := make([]interface{}, 0, len(deaths)+1)
+	for _, d := range deaths {
+		prev, ok := d.(amqp.Table)
+		if ok && prev["queue"] == death["queue"] && prev["reason"] == death["reason"] {
+			count += int64(headerInt(prev, "count"))
+			continue
+		}
+		rest = append(rest, d)
+	}
+	death["count"] = count
+	return append([]interface{}{death}, rest...)
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := range q.consumers {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.autoAck || c.ch.prefetch == 0 || c.inFlight < c.ch.prefetch {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func topicMatch(pattern, key string) bool {
+	return topicMatchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func topicMatchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatchWords(pattern[1:], words[1:])
+	}
+}
+
+func copyTable(t amqp.Table) amqp.Table {
+	c := make(amqp.Table, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+type memChannel struct {
+	broker     *MemoryBroker
+	closed     bool
+	confirm    bool
+	prefetch   int
+	nextTag    uint64
+	consumers  map[string]*memConsumer
+	unacked    map[uint64]*memUnacked
+	returns    []chan amqp.Return
+	replyQueue *memQueue
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	msg      *memMessage
+	consumer *memConsumer
+}
+
+type memConsumer struct {
+	tag        string
+	ch         *memChannel
+	queue      *memQueue
+	autoAck    bool
+	inFlight   int
+	pending    []memPending
+	wake       chan struct{}
+	stop       chan struct{}
+	stopped    bool
+	deliveries chan amqp.Delivery
+}
+
+type memPending struct {
+	delivery amqp.Delivery
+	msg      *memMessage
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeTopic, amqp.ExchangeFanout:
+	default:
+		return &amqp.Error{Code: amqp.NotImplemented, Reason: fmt.Sprintf("NOT_IMPLEMENTED - exchange type '%s'", kind)}
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{kind: kind, durable: durable}
+	return nil
+}
+
+// ExchangeDeclarePassive checks that the exchange exists. Like RabbitMQ, it
+// does not compare the exchange's type or durability.
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name)}
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = fmt.Sprintf("amq.gen-%d", b.nextID())
+	}
+	q, ok := b.queues[name]
+	if ok {
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)}
+		}
+	} else {
+		q = &memQueue{
+			name:       name,
+			durable:    durable,
+			autoDelete: autoDelete,
+			exclusive:  exclusive,
+			args:       copyTable(args),
+		}
+		b.queues[name] = q
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange)}
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	binding := memBinding{queue: name, key: key}
+	if !slices.Contains(ex.bindings, binding) {
+		ex.bindings = append(ex.bindings, binding)
+	}
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	for _, c := range ch.consumers {
+		b.dispatchLocked(c.queue)
+	}
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	if queue == directReplyTo {
+		if !autoAck {
+			return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - reply consumer cannot acknowledge"}
+		}
+		if ch.replyQueue == nil {
+			ch.replyQueue = &memQueue{
+				name:       fmt.Sprintf("%s.%d", directReplyTo, b.nextID()),
+				autoDelete: true,
+				exclusive:  true,
+			}
+			b.queues[ch.replyQueue.name] = ch.replyQueue
+		}
+		queue = ch.replyQueue.name
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue)}
+	}
+	if consumer == "" {
+		consumer = fmt.Sprintf("ctag-%d", b.nextID())
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, &amqp.Error{Code: amqp.NotAllowed, Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)}
+	}
+	c := &memConsumer{
+		tag:        consumer,
+		ch:         ch,
+		queue:      q,
+		autoAck:    autoAck,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		deliveries: make(chan amqp.Delivery),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.hadConsumers = true
+	go c.forward(b)
+	b.dispatchLocked(q)
+	return c.deliveries, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.stopConsumerLocked(c)
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, err := ch.publish(exchange, key, mandatory, msg)
+	return err
+}
+
+// publish routes msg and reports whether a confirm would ack it, which it
+// would not if a full queue rejected it.
+func (ch *memChannel) publish(exchange, key string, mandatory bool, msg amqp.Publishing) (bool, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return false, amqp.ErrClosed
+	}
+	if msg.ReplyTo == directReplyTo {
+		if ch.replyQueue == nil {
+			return false, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - fast reply consumer does not exist"}
+		}
+		msg.ReplyTo = ch.replyQueue.name
+	}
+	routed, rejected, err := b.routeLocked(exchange, key, msg)
+	if err != nil {
+		return false, err
+	}
+	if routed == 0 && mandatory {
+		ret := amqp.Return{
+			ReplyCode:     amqp.NoRoute,
+			ReplyText:     "NO_ROUTE",
+			Exchange:      exchange,
+			RoutingKey:    key,
+			ContentType:   msg.ContentType,
+			Headers:       msg.Headers,
+			CorrelationId: msg.CorrelationId,
+			ReplyTo:       msg.ReplyTo,
+			MessageId:     msg.MessageId,
+			Body:          msg.Body,
+		}
+		for _, r := range ch.returns {
+			select {
+			case r <- ret:
+			default:
+			}
+		}
+	}
+	return !rejected, nil
+}
+
+func (ch *memChannel) PublishWithConfirm(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (Confirmation, error) {
+	ch.broker.mu.Lock()
+	confirm := ch.confirm
+	ch.broker.mu.Unlock()
+	if !confirm {
+		return nil, errNotInConfirmMode
+	}
+	ack, err := ch.publish(exchange, key, mandatory, msg)
+	if err != nil {
+		return nil, err
+	}
+	return memConfirmation{ack: ack}, nil
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) IsClosed() bool {
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+	return ch.closed
+}
+
+func (ch *memChannel) Close() error {
+	ch.broker.mu.Lock()
+	defer ch.broker.mu.Unlock()
+	ch.closeLocked()
+	return nil
+}
+
+// closeLocked stops the channel's consumers and returns its unacked
+// messages to their queues, as RabbitMQ does when a channel goes away.
+func (ch *memChannel) closeLocked() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	b := ch.broker
+	for _, c := range ch.consumers {
+		ch.stopConsumerLocked(c)
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	requeue := map[*memQueue][]*memMessage{}
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		requeue[u.queue] = append(requeue[u.queue], u.msg)
+	}
+	ch.unacked = map[uint64]*memUnacked{}
+	for q, msgs := range requeue {
+		b.requeueLocked(q, msgs)
+	}
+	for _, r := range ch.returns {
+		close(r)
+	}
+	ch.returns = nil
+	if ch.replyQueue != nil {
+		b.deleteQueueLocked(ch.replyQueue)
+	}
+	delete(b.channels, ch)
+}
+
+// stopConsumerLocked detaches c from its queue and requeues what it had been
+// assigned but not yet handed to the application.
+func (ch *memChannel) stopConsumerLocked(c *memConsumer) {
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	close(c.stop)
+	delete(ch.consumers, c.tag)
+	q := c.queue
+	q.consumers = slices.DeleteFunc(q.consumers, func(other *memConsumer) bool {
+		return other == c
+	})
+	var msgs []*memMessage
+	for _, p := range c.pending {
+		delete(ch.unacked, p.delivery.DeliveryTag)
+		msgs = append(msgs, p.msg)
+	}
+	c.pending = nil
+	if q.autoDelete && q.hadConsumers && len(q.consumers) == 0 {
+		ch.broker.deleteQueueLocked(q)
+		return
+	}
+	ch.broker.requeueLocked(q, msgs)
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settled, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range settled {
+		if !u.queue.deleted {
+			b.dispatchLocked(u.queue)
+		}
+	}
+	return nil
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple, requeue bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settled, err := ch.settleLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	requeued := map[*memQueue][]*memMessage{}
+	for _, u := range settled {
+		if requeue {
+			requeued[u.queue] = append(requeued[u.queue], u.msg)
+			continue
+		}
+		b.deadLetterLocked(u.queue, u.msg, "rejected")
+		if !u.queue.deleted {
+			b.dispatchLocked(u.queue)
+		}
+	}
+	for q, msgs := range requeued {
+		b.requeueLocked(q, msgs)
+	}
+	return nil
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settleLocked removes tag, and every earlier tag if multiple is set, from
+// the unacked messages and frees their consumers' prefetch slots.
+func (ch *memChannel) settleLocked(tag uint64, multiple bool) ([]*memUnacked, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	tags := []uint64{tag}
+	if multiple {
+		tags = tags[:0]
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		slices.Sort(tags)
+	}
+	var settled []*memUnacked
+	for _, t := range tags {
+		u, ok := ch.unacked[t]
+		if !ok {
+			return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", t)}
+		}
+		delete(ch.unacked, t)
+		u.consumer.inFlight--
+		settled = append(settled, u)
+	}
+	return settled, nil
+}
+
+func (c *memConsumer) deliverLocked(q *memQueue, m *memMessage) {
+	ch := c.ch
+	ch.nextTag++
+	d := amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         copyTable(m.msg.Headers),
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		ConsumerTag:     c.tag,
+		DeliveryTag:     ch.nextTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            m.msg.Body,
+	}
+	if !c.autoAck {
+		ch.unacked[d.DeliveryTag] = &memUnacked{queue: q, msg: m, consumer: c}
+		c.inFlight++
+	}
+	c.pending = append(c.pending, memPending{delivery: d, msg: m})
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward hands pending deliveries to the application outside the broker
+// lock and closes the delivery channel once the consumer is stopped.
+func (c *memConsumer) forward(b *MemoryBroker) {
+	defer close(c.deliveries)
+	for {
+		b.mu.Lock()
+		if c.stopped {
+			b.mu.Unlock()
+			return
+		}
+		if len(c.pending) == 0 {
+			b.mu.Unlock()
+			select {
+			case <-c.wake:
+			case <-c.stop:
+			}
+			continue
+		}
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		b.mu.Unlock()
+		select {
+		case c.deliveries <- p.delivery:
+		case <-c.stop:
+			b.mu.Lock()
+			if c.autoAck {
+				b.requeueLocked(c.queue, []*memMessage{p.msg})
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+type memConfirmation struct {
+	ack bool
+}
+
+func (c memConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	return c.ack, nil
+}
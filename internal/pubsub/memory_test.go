@@ -0,0 +1,295 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const deliveryTimeout = time.Second
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a", false},
+		{"a.*", "a.b.c", false},
+		{"*.b", "a.b", true},
+		{"*.*", "a", false},
+		{"#", "a.b.c", true},
+		{"#", "", true},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"a.#", "b.a", false},
+		{"#.c", "c", true},
+		{"#.c", "a.b.c", true},
+		{"#.c", "a.b", false},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.b.c", true},
+		{"a.#.c", "a.b.d", false},
+		{"a.*.#", "a", false},
+		{"a.*.#", "a.b", true},
+		{"*.#.*", "a", false},
+		{"*.#.*", "a.b", true},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+// newTestChannel returns a channel on a fresh broker with a direct "work"
+// exchange routing key "work" to the "work" queue, which dead-letters to the
+// "dead" queue.
+func newTestChannel(t *testing.T) Channel {
+	t.Helper()
+	b := NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	ch, err := b.Channel(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustDeclare := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustDeclare(ch.ExchangeDeclare("work", amqp.ExchangeDirect, false, false, false, false, nil))
+	mustDeclare(ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, false, false, false, false, nil))
+	_, err = ch.QueueDeclare("work", false, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+	mustDeclare(err)
+	_, err = ch.QueueDeclare("dead", false, false, false, false, nil)
+	mustDeclare(err)
+	mustDeclare(ch.QueueBind("work", "work", "work", false, nil))
+	mustDeclare(ch.QueueBind("dead", "", "dlx", false, nil))
+	return ch
+}
+
+func publishTest(t *testing.T, ch Channel, exchange, key string, msg amqp.Publishing) {
+	t.Helper()
+	if err := ch.PublishWithContext(context.Background(), exchange, key, false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func consumeTest(t *testing.T, ch Channel, queue string) <-chan amqp.Delivery {
+	t.Helper()
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(deliveryTimeout):
+		t.Fatal("timed out waiting for a delivery")
+		return amqp.Delivery{}
+	}
+}
+
+func expectNothing(t *testing.T, deliveries <-chan amqp.Delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery of %q", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryAck(t *testing.T) {
+	ch := newTestChannel(t)
+	deliveries := consumeTest(t, ch, "work")
+	publishTest(t, ch, "work", "work", amqp.Publishing{Body: []byte("a")})
+	d := receive(t, deliveries)
+	if string(d.Body) != "a" || d.Redelivered {
+		t.Fatalf("got %q, redelivered %v", d.Body, d.Redelivered)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, deliveries)
+}
+
+func TestMemoryNackRequeue(t *testing.T) {
+	ch := newTestChannel(t)
+	deliveries := consumeTest(t, ch, "work")
+	publishTest(t, ch, "work", "work", amqp.Publishing{Body: []byte("a")})
+	d := receive(t, deliveries)
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, deliveries)
+	if string(d.Body) != "a" || !d.Redelivered {
+		t.Fatalf("got %q, redelivered %v, want a redelivery of \"a\"", d.Body, d.Redelivered)
+	}
+	d.Ack(false)
+}
+
+func TestMemoryCloseRequeuesUnacked(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+	ch, _ := b.Channel(ctx)
+	if _, err := ch.QueueDeclare("q", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	publishTest(t, ch, "", "q", amqp.Publishing{Body: []byte("a")})
+	consumer, _ := b.Channel(ctx)
+	receive(t, consumeTest(t, consumer, "q"))
+	consumer.Close()
+	d := receive(t, consumeTest(t, ch, "q"))
+	if !d.Redelivered {
+		t.Error("delivery unacked by a closed channel is not marked redelivered")
+	}
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	ch := newTestChannel(t)
+	work := consumeTest(t, ch, "work")
+	dead := consumeTest(t, ch, "dead")
+	publishTest(t, ch, "work", "work", amqp.Publishing{Body: []byte("a")})
+
+	for count := 1; count <= 2; count++ {
+		receive(t, work).Nack(false, false)
+		d := receive(t, dead)
+		deaths, _ := d.Headers["x-death"].([]interface{})
+		if len(deaths) != 1 {
+			t.Fatalf("got %d x-death entries, want 1", len(deaths))
+		}
+		death := deaths[0].(amqp.Table)
+		if death["queue"] != "work" || death["reason"] != "rejected" || death["exchange"] != "work" {
+			t.Errorf("x-death = %v", death)
+		}
+		if got := headerInt(death, "count"); got != count {
+			t.Errorf("x-death count = %d, want %d", got, count)
+		}
+		d.Ack(false)
+		publishTest(t, ch, "work", "work", republishing(d))
+	}
+}
+
+func TestMemoryExpiredMessagesAreDeadLettered(t *testing.T) {
+	ch := newTestChannel(t)
+	dead := consumeTest(t, ch, "dead")
+	publishTest(t, ch, "work", "work", amqp.Publishing{Body: []byte("a"), Expiration: "10"})
+	d := receive(t, dead)
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 || deaths[0].(amqp.Table)["reason"] != "expired" {
+		t.Errorf("x-death = %v, want one expired entry", d.Headers["x-death"])
+	}
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	ch := newTestChannel(t)
+	if err := ch.Qos(2, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	deliveries := consumeTest(t, ch, "work")
+	for _, body := range []string{"a", "b", "c"} {
+		publishTest(t, ch, "work", "work", amqp.Publishing{Body: []byte(body)})
+	}
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+	expectNothing(t, deliveries)
+	first.Ack(false)
+	if d := receive(t, deliveries); string(d.Body) != "c" {
+		t.Errorf("got %q after ack, want \"c\"", d.Body)
+	}
+}
+
+func TestMemoryPrefetchRoundRobin(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ctx := context.Background()
+	ch, _ := b.Channel(ctx)
+	if _, err := ch.QueueDeclare("q", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	var consumers []<-chan amqp.Delivery
+	for range 2 {
+		c, _ := b.Channel(ctx)
+		c.Qos(1, 0, false)
+		consumers = append(consumers, consumeTest(t, c, "q"))
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		publishTest(t, ch, "", "q", amqp.Publishing{Body: []byte(body)})
+	}
+	a := receive(t, consumers[0])
+	second := receive(t, consumers[1])
+	if string(a.Body) != "a" || string(second.Body) != "b" {
+		t.Fatalf("got %q and %q, want \"a\" and \"b\"", a.Body, second.Body)
+	}
+	expectNothing(t, consumers[0])
+	second.Ack(false)
+	if d := receive(t, consumers[1]); string(d.Body) != "c" {
+		t.Errorf("got %q, want \"c\" on the consumer with room", d.Body)
+	}
+}
+
+func TestMemoryOverflow(t *testing.T) {
+	tests := []struct {
+		overflow Overflow
+		kept     []string
+		dead     []string
+		nacked   bool
+	}{
+		{OverflowDropHead, []string{"b", "c"}, []string{"a"}, false},
+		{OverflowRejectPublish, []string{"a", "b"}, nil, true},
+		{OverflowRejectPublishDLX, []string{"a", "b"}, []string{"c"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.overflow), func(t *testing.T) {
+			ctx := context.Background()
+			b := NewMemoryBroker()
+			defer b.Close()
+			ch, _ := b.Channel(ctx)
+			ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, false, false, false, false, nil)
+			ch.QueueDeclare("dead", false, false, false, false, nil)
+			ch.QueueBind("dead", "", "dlx", false, nil)
+			args := amqp.Table{"x-dead-letter-exchange": "dlx"}
+			WithMaxLength(2)(args)
+			WithOverflow(tt.overflow)(args)
+			if _, err := ch.QueueDeclare("q", false, false, false, false, args); err != nil {
+				t.Fatal(err)
+			}
+			ch.Confirm(false)
+			var err error
+			for _, body := range []string{"a", "b", "c"} {
+				err = publishConfirmed(ctx, ch, "", "q", amqp.Publishing{Body: []byte(body)}, deliveryTimeout)
+			}
+			var nackErr *PublishNackError
+			if nacked := errors.As(err, &nackErr); nacked != tt.nacked {
+				t.Errorf("publish to a full queue returned %v, want nacked %v", err, tt.nacked)
+			}
+			for queue, want := range map[string][]string{"q": tt.kept, "dead": tt.dead} {
+				var got []string
+				deliveries := consumeTest(t, ch, queue)
+				for range want {
+					d := receive(t, deliveries)
+					got = append(got, string(d.Body))
+					d.Ack(false)
+				}
+				expectNothing(t, deliveries)
+				if !slices.Equal(got, want) {
+					t.Errorf("%s holds %v, want %v", queue, got, want)
+				}
+			}
+		})
+	}
+}
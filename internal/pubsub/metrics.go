@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "peril"
+
+var (
+	publishesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "publishes_total",
+		Help:      "Messages published, by exchange, routing key pattern and result.",
+	}, []string{"exchange", "key", "result"})
+
+	deliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deliveries_total",
+		Help:      "Messages delivered to subscriptions, by queue.",
+	}, []string{"queue"})
+
+	outcomesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_outcomes_total",
+		Help:      "How handled messages were settled, by queue and outcome.",
+	}, []string{"queue", "outcome"})
+
+	decodeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_failures_total",
+		Help:      "Deliveries that could not be decoded, by queue.",
+	}, []string{"queue"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in handlers, including middleware, by queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"queue"})
+)
+
+// Outcomes recorded for deliveries that never reach the handler.
+const (
+	outcomeDuplicate = "duplicate"
+	outcomeForged    = "forged"
+	outcomeStale     = "stale"
+)
+
+// keyLabel collapses routing keys into few enough label values to keep the
+// number of series bounded. Direct reply-to names, unique to every call,
+// become one value, and keys made of a prefix and a username, such as
+// game_logs.<username>, become the pattern they are bound with.
+func keyLabel(key string) string {
+	if strings.HasPrefix(key, directReplyTo) {
+		return directReplyTo
+	}
+	if prefix, _, ok := strings.Cut(key, "."); ok {
+		return prefix + ".*"
+	}
+	return key
+}
+
+func observePublish(exchange, key string, err error) {
+	result := "ok"
+	var nackErr *PublishNackError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrConfirmTimeout):
+		result = "timeout"
+	case errors.As(err, &nackErr):
+		result = "nacked"
+	default:
+		result = "error"
+	}
+	publishesTotal.WithLabelValues(exchange, keyLabel(key), result).Inc()
+}
+
+func observeHandled(queue string, ack AckType, start time.Time) {
+	handlerDuration.WithLabelValues(queue).Observe(time.Since(start).Seconds())
+	outcomesTotal.WithLabelValues(queue, ack.String()).Inc()
+}
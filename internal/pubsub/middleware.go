@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain wraps handler so that middlewares run in the order given, the first
+// one being the outermost.
+func Chain[T any](handler Handler[T], middlewares ...Middleware[T]) Handler[T] {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+var (
+	globalMiddlewareMu sync.RWMutex
+	globalMiddleware   []Middleware[any]
+)
+
+// Use installs middlewares on every subscription created afterwards. They
+// run before the subscription's own middlewares.
+func Use(middlewares ...Middleware[any]) {
+	globalMiddlewareMu.Lock()
+	defer globalMiddlewareMu.Unlock()
+	globalMiddleware = append(globalMiddleware, middlewares...)
+}
+
+// WithMiddleware wraps the subscription's handler in middlewares, inside
+// those installed with Use. T is either the subscription's message type or
+// any, for middlewares that handle every type; Subscribe fails otherwise.
+func WithMiddleware[T any](middlewares ...Middleware[T]) SubscribeOption {
+	return func(o *subscribeOptions) {
+		for _, middleware := range middlewares {
+			o.middleware = append(o.middleware, middleware)
+		}
+	}
+}
+
+// applyMiddleware wraps handler in the global middlewares and then in
+// middlewares, each either a Middleware[T] or a Middleware[any].
+func applyMiddleware[T any](handler Handler[T], middlewares []any) (Handler[T], error) {
+	globalMiddlewareMu.RLock()
+	all := make([]any, 0, len(globalMiddleware)+len(middlewares))
+	for _, middleware := range globalMiddleware {
+		all = append(all, middleware)
+	}
+	globalMiddlewareMu.RUnlock()
+	all = append(all, middlewares...)
+	for i := len(all) - 1; i >= 0; i-- {
+		switch middleware := all[i].(type) {
+		case Middleware[T]:
+			handler = middleware(handler)
+		case Middleware[any]:
+			handler = adaptMiddleware(middleware, handler)
+		default:
+			var t T
+			return nil, fmt.Errorf("middleware %T cannot handle %T", middleware, t)
+		}
+	}
+	return handler, nil
+}
+
+// adaptMiddleware wraps handler in a type-agnostic middleware by passing the
+// decoded message through it as an any.
+func adaptMiddleware[T any](middleware Middleware[any], handler Handler[T]) Handler[T] {
+	wrapped := middleware(func(v any, env Envelope) AckType {
+		t, _ := v.(T)
+		return handler(t, env)
+	})
+	return func(t T, env Envelope) AckType {
+		return wrapped(t, env)
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard and logs the stack.
+func Recover[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(t T, env Envelope) (ack AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger().Error("recovered from panic in handler", "message_id", env.MessageID, "routing_key", env.RoutingKey, "panic", r, "stack", string(debug.Stack()))
+					ack = NackDiscard
+				}
+			}()
+			return next(t, env)
+		}
+	}
+}
+
+func Logging[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(t T, env Envelope) AckType {
+			ack := next(t, env)
+			logger().Info("handled message", "message_id", env.MessageID, "routing_key", env.RoutingKey, "username", env.Sender, "outcome", ack.String())
+			return ack
+		}
+	}
+}
+
+func Timing[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(t T, env Envelope) AckType {
+			start := time.Now()
+			ack := next(t, env)
+			logger().Info("handler finished", "message_id", env.MessageID, "routing_key", env.RoutingKey, "duration", time.Since(start))
+			return ack
+		}
+	}
+}
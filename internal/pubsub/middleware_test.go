@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type greeting struct {
+	Text string
+}
+
+func TestWithMiddleware(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	defer b.Close()
+	if err := DeclareExchanges(ctx, b, Exchange{Name: "ex", Kind: amqp.ExchangeDirect}); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	typed := func(next Handler[greeting]) Handler[greeting] {
+		return func(g greeting, env Envelope) AckType {
+			calls = append(calls, "typed "+g.Text)
+			g.Text += "!"
+			return next(g, env)
+		}
+	}
+	untyped := func(next Handler[any]) Handler[any] {
+		return func(v any, env Envelope) AckType {
+			calls = append(calls, "untyped "+v.(greeting).Text)
+			return next(v, env)
+		}
+	}
+	handled := make(chan greeting, 1)
+	sub, err := Subscribe(ctx, b, JSON, "ex", "greetings", "greetings", TransientQueue, func(g greeting, _ Envelope) AckType {
+		handled <- g
+		return Ack
+	}, WithMiddleware[greeting](typed), WithMiddleware[any](untyped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	pub := NewPublisher(b)
+	defer pub.Close()
+	if err := pub.PublishConfirmed(ctx, JSON, "ex", "greetings", greeting{Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if g := <-handled; g.Text != "hi!" {
+		t.Errorf("handler got %q, want the typed middleware's \"hi!\"", g.Text)
+	}
+	if len(calls) != 2 || calls[0] != "typed hi" || calls[1] != "untyped hi!" {
+		t.Errorf("middlewares ran as %q, want typed then untyped", calls)
+	}
+}
+
+func TestWithMiddlewareOfAnotherType(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	defer b.Close()
+	wrongType := func(next Handler[string]) Handler[string] { return next }
+	_, err := Subscribe(ctx, b, JSON, "", "greetings", "greetings", TransientQueue, func(greeting, Envelope) AckType {
+		return Ack
+	}, WithMiddleware[string](wrongType))
+	if err == nil {
+		t.Error("Subscribe accepted a middleware for another message type")
+	}
+}
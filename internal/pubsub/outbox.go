@@ -0,0 +1,246 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	outboxOpEnqueue   = "enqueue"
+	outboxOpDelivered = "delivered"
+)
+
+// outboxRecord is one line of the outbox file. A message is pending from its
+// enqueue record until a delivered record with the same ID follows it.
+type outboxRecord struct {
+	Op       string           `json:"op"`
+	ID       string           `json:"id"`
+	Exchange string           `json:"exchange,omitempty"`
+	Key      string           `json:"key,omitempty"`
+	Message  *amqp.Publishing `json:"message,omitempty"`
+}
+
+// Outbox writes messages to a local append-only file before they are
+// published, and relays them to the broker in the background, in order,
+// with publisher confirms. Messages that could not be delivered before the
+// process exits are relayed the next time the outbox is opened.
+type Outbox struct {
+	pub  *Publisher
+	mu   sync.Mutex
+	file *os.File
+	// pending holds the records not delivered yet, oldest first.
+	pending []outboxRecord
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func OpenOutbox(path string, pub *Publisher) (*Outbox, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	pending, err := readOutbox(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Outbox{
+		pub:     pub,
+		file:    f,
+		pending: pending,
+		wake:    make(chan struct{}, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if err := o.rewrite(); err != nil {
+		cancel()
+		f.Close()
+		return nil, err
+	}
+	if len(pending) > 0 {
+		logger().Info("relaying messages left in the outbox", "pending", len(pending))
+	}
+	go o.relay(ctx)
+	return o, nil
+}
+
+// readOutbox replays the outbox file and returns the messages still pending.
+// A last record without its newline was torn by a crash while it was being
+// written, before Publish could return, so it is dropped; OpenOutbox then
+// rewrites the file without it. Any other unreadable record is an error.
+func readOutbox(f *os.File) ([]outboxRecord, error) {
+	var pending []outboxRecord
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logger().Warn("dropping torn record at the end of the outbox", "size", len(line))
+			}
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read outbox: %w", err)
+		}
+		var rec outboxRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("could not read outbox record: %w", err)
+		}
+		switch rec.Op {
+		case outboxOpEnqueue:
+			pending = append(pending, rec)
+		case outboxOpDelivered:
+			for i := range pending {
+				if pending[i].ID == rec.ID {
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return pending, nil
+}
+
+// Publish durably records the message and returns; it is delivered to the
+// broker by the outbox's relay. An error means the message was not recorded
+// and will never be published.
+func (o *Outbox) Publish(codec Codec, exchange, key string, val any, opts ...PublishOption) error {
+	msg, err := o.pub.newPublishing(codec, exchange, key, val, opts)
+	if err != nil {
+		return err
+	}
+	rec := outboxRecord{
+		Op:       outboxOpEnqueue,
+		ID:       msg.MessageId,
+		Exchange: exchange,
+		Key:      key,
+		Message:  &msg,
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.append(rec); err != nil {
+		return err
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync outbox: %w", err)
+	}
+	o.pending = append(o.pending, rec)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns how many messages are waiting to be delivered.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Close stops the relay and closes the file. Pending messages stay in the
+// file.
+func (o *Outbox) Close() error {
+	o.cancel()
+	<-o.done
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+func (o *Outbox) relay(ctx context.Context) {
+	defer close(o.done)
+	backoff := minReconnectBackoff
+	for {
+		o.mu.Lock()
+		var rec outboxRecord
+		hasNext := len(o.pending) > 0
+		if hasNext {
+			rec = o.pending[0]
+		}
+		o.mu.Unlock()
+		if !hasNext {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+			}
+			continue
+		}
+		err := o.pub.publishConfirmed(ctx, rec.Exchange, rec.Key, *rec.Message)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger().Warn("error relaying message from outbox", "message_id", rec.ID, "exchange", rec.Exchange, "routing_key", rec.Key, "retry_in", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxReconnectBackoff)
+			continue
+		}
+		backoff = minReconnectBackoff
+		o.delivered(rec.ID)
+	}
+}
+
+// delivered records that the head of the outbox was published. The file is
+// truncated whenever nothing is left pending, so it does not grow forever.
+func (o *Outbox) delivered(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = o.pending[1:]
+	var err error
+	if len(o.pending) == 0 {
+		err = o.rewrite()
+	} else {
+		err = o.append(outboxRecord{Op: outboxOpDelivered, ID: id})
+	}
+	if err != nil {
+		logger().Error("error recording delivery in outbox", "message_id", id, "error", err)
+	}
+}
+
+func (o *Outbox) append(rec outboxRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox record: %w", err)
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write outbox record: %w", err)
+	}
+	return nil
+}
+
+// rewrite replaces the contents of the file with the pending records.
+func (o *Outbox) rewrite() error {
+	if err := o.file.Truncate(0); err != nil {
+		return fmt.Errorf("could not rewrite outbox: %w", err)
+	}
+	if _, err := o.file.Seek(0, 0); err != nil {
+		return fmt.Errorf("could not rewrite outbox: %w", err)
+	}
+	for _, rec := range o.pending {
+		if err := o.append(rec); err != nil {
+			return err
+		}
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("could not sync outbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func outboxLine(t *testing.T, rec outboxRecord) []byte {
+	t.Helper()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(line, '\n')
+}
+
+func pendingRecord(t *testing.T, key, text string) outboxRecord {
+	t.Helper()
+	msg, err := newPublishing(JSON, greeting{Text: text}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outboxRecord{Op: outboxOpEnqueue, ID: msg.MessageId, Key: key, Message: &msg}
+}
+
+func TestOutboxDropsTornLastRecord(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	ch, _ := b.Channel(context.Background())
+	if _, err := ch.QueueDeclare("q", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	torn := outboxLine(t, pendingRecord(t, "q", "torn"))
+	torn = torn[:len(torn)/2]
+	data := append(outboxLine(t, pendingRecord(t, "q", "kept")), torn...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := NewPublisher(b)
+	defer pub.Close()
+	outbox, err := OpenOutbox(path, pub)
+	if err != nil {
+		t.Fatalf("OpenOutbox with a torn last record returned %v", err)
+	}
+	defer outbox.Close()
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, torn) {
+		t.Error("torn record was left in the outbox file")
+	}
+	deliveries := consumeTest(t, ch, "q")
+	if d := receive(t, deliveries); !bytes.Contains(d.Body, []byte("kept")) {
+		t.Errorf("relayed %s, want the record before the torn one", d.Body)
+	}
+	expectNothing(t, deliveries)
+}
+
+func TestOutboxRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	data := append([]byte("{not json\n"), outboxLine(t, pendingRecord(t, "q", "hi"))...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewMemoryBroker()
+	defer b.Close()
+	pub := NewPublisher(b)
+	defer pub.Close()
+	if outbox, err := OpenOutbox(path, pub); err == nil {
+		outbox.Close()
+		t.Error("OpenOutbox accepted a corrupt record before the last one")
+	}
+}
@@ -0,0 +1,169 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderDecodeError        = "x-decode-error"
+	HeaderDecodeAttempts     = "x-decode-attempts"
+	HeaderOriginalQueue      = "x-original-queue"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+)
+
+const republishConfirmTimeout = 5 * time.Second
+
+type decodeFailurePolicy uint8
+
+const (
+	decodeFailureDeadLetter decodeFailurePolicy = iota
+	decodeFailureDiscard
+	decodeFailureRequeue
+)
+
+// DeadLetterUndecodable publishes deliveries that fail to decode to the
+// dead-letter exchange, with headers recording the decode error and where
+// the message came from. This is the default.
+func DeadLetterUndecodable() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = decodeFailureDeadLetter
+	}
+}
+
+func DiscardUndecodable() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = decodeFailureDiscard
+	}
+}
+
+// RequeueUndecodable sends deliveries that fail to decode to the back of the
+// queue up to limit times, then dead-letters them.
+func RequeueUndecodable(limit int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = decodeFailureRequeue
+		o.decodeRequeueLimit = limit
+	}
+}
+
+// rejectUndecodable settles msg according to the subscription's decode
+// failure policy. Every path acks or nacks msg so it never holds on to a
+// slot of the prefetch window.
+func (c *consumer[T]) rejectUndecodable(ctx context.Context, msg amqp.Delivery, decodeErr error) {
+	switch c.options.decodeFailure {
+	case decodeFailureDiscard:
+		c.log.Warn("discarding undecodable message", "message_id", msg.MessageId)
+		msg.Ack(false)
+		return
+	case decodeFailureRequeue:
+		attempts := headerInt(msg.Headers, HeaderDecodeAttempts)
+		if attempts < c.options.decodeRequeueLimit {
+			pub := republishing(msg)
+			recordOriginalRoute(pub.Headers, msg)
+			pub.Headers[HeaderDecodeAttempts] = int32(attempts + 1)
+			err := c.republish(ctx, "", c.queueName, pub)
+			if err == nil {
+				c.log.Warn("requeuing undecodable message", "message_id", msg.MessageId, "attempts", attempts+1)
+				msg.Ack(false)
+				return
+			}
+			c.log.Error("error requeuing undecodable message", "message_id", msg.MessageId, "error", err)
+		}
+	}
+	c.deadLetter(ctx, msg, decodeErr)
+}
+
+func (c *consumer[T]) deadLetter(ctx context.Context, msg amqp.Delivery, decodeErr error) {
+	pub := republishing(msg)
+	pub.Headers[HeaderDecodeError] = decodeErr.Error()
+	pub.Headers[HeaderOriginalQueue] = c.queueName
+	recordOriginalRoute(pub.Headers, msg)
+	if err := c.republish(ctx, routing.ExchangePerilDLX, msg.RoutingKey, pub); err != nil {
+		c.log.Error("error dead-lettering message, nacking it instead", "message_id", msg.MessageId, "error", err)
+		msg.Nack(false, false)
+		return
+	}
+	c.log.Warn("dead-lettered undecodable message", "message_id", msg.MessageId)
+	msg.Ack(false)
+}
+
+// republish publishes on a channel of its own so that a failed publish, such
+// as one to a missing exchange, cannot close the consumer's channel.
+func (c *consumer[T]) republish(ctx context.Context, exchange, key string, pub amqp.Publishing) error {
+	ch, err := c.broker.Channel(ctx)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("error enabling publisher confirms: %s", err)
+	}
+	return publishConfirmed(ctx, ch, exchange, key, pub, republishConfirmTimeout)
+}
+
+// originalRoute returns the exchange and routing key msg was first published
+// with, which differ from those it was delivered with if it was republished
+// straight to its queue.
+func originalRoute(msg amqp.Delivery) (exchange, key string) {
+	if msg.Exchange == "" {
+		if exchange, ok := msg.Headers[HeaderOriginalExchange].(string); ok {
+			key, _ := msg.Headers[HeaderOriginalRoutingKey].(string)
+			return exchange, key
+		}
+	}
+	return msg.Exchange, msg.RoutingKey
+}
+
+// recordOriginalRoute keeps msg's original route in headers, the headers of
+// a republishing of msg.
+func recordOriginalRoute(headers amqp.Table, msg amqp.Delivery) {
+	headers[HeaderOriginalExchange], headers[HeaderOriginalRoutingKey] = originalRoute(msg)
+}
+
+// republishing copies msg into a new publishing with its own headers table.
+func republishing(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+func headerInt(headers amqp.Table, key string) int {
+	switch v := headers[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		// Headers that went through JSON, like those of outbox records,
+		// come back as float64.
+		return int(v)
+	}
+	return 0
+}
@@ -1,34 +1,230 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	jsonBytes, err := json.Marshal(val)
+var ErrConfirmTimeout = errors.New("timed out waiting for publisher confirm")
+
+type PublishNackError struct {
+	Exchange string
+	Key      string
+}
+
+func (e *PublishNackError) Error() string {
+	return fmt.Sprintf("broker nacked message published to exchange '%s' with key '%s'", e.Exchange, e.Key)
+}
+
+// publishConfirmed publishes on ch, which must already be in confirm mode,
+// and blocks until the broker acks or nacks the message, or timeout elapses.
+func publishConfirmed(ctx context.Context, ch Channel, exchange, key string, msg amqp.Publishing, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	confirmation, err := ch.PublishWithConfirm(ctx, exchange, key, false, false, msg)
 	if err != nil {
 		return err
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        jsonBytes,
-	})
+	acked, err := confirmation.WaitContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrConfirmTimeout
+	}
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return &PublishNackError{Exchange: exchange, Key: key}
+	}
+	return nil
+}
+
+const (
+	defaultPublisherPoolSize       = 4
+	defaultPublisherConfirmTimeout = 5 * time.Second
+)
+
+var ErrPublisherClosed = errors.New("publisher closed")
+
+// Publisher publishes over a bounded set of channels that are reused across
+// calls. It is safe for concurrent use; callers block while every channel is
+// busy. Channels are put in confirm mode once, when they are opened.
+// Channels closed by the broker are dropped and replaced on demand, which
+// also carries the publisher across reconnects.
+type Publisher struct {
+	broker         Broker
+	sender         string
+	idle           chan Channel
+	open           chan struct{}
+	confirmTimeout time.Duration
+
+	compression          Compression
+	compressionThreshold int
+	signingKey           ed25519.PrivateKey
+	certificate          Certificate
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type PublisherOption func(*Publisher)
+
+func WithPoolSize(size int) PublisherOption {
+	return func(p *Publisher) {
+		size = max(size, 1)
+		p.idle = make(chan Channel, size)
+		p.open = make(chan struct{}, size)
+	}
+}
+
+// WithSender stamps every message with the username of the player, or the
+// name of the service, publishing it.
+func WithSender(sender string) PublisherOption {
+	return func(p *Publisher) {
+		p.sender = sender
+	}
+}
+
+func WithConfirmTimeout(timeout time.Duration) PublisherOption {
+	return func(p *Publisher) {
+		p.confirmTimeout = timeout
+	}
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(val); err != nil {
-		return fmt.Errorf("error encoding '%v' to gob: %s", val, err)
+func NewPublisher(b Broker, opts ...PublisherOption) *Publisher {
+	p := &Publisher{
+		broker:         b,
+		confirmTimeout: defaultPublisherConfirmTimeout,
+		closed:         make(chan struct{}),
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buf.Bytes(),
+	WithPoolSize(defaultPublisherPoolSize)(p)
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *Publisher) Publish(ctx context.Context, codec Codec, exchange, key string, val any, opts ...PublishOption) error {
+	msg, err := p.newPublishing(codec, exchange, key, val, opts)
+	if err != nil {
+		return err
+	}
+	done := instrumentPublish(ctx, exchange, key, &msg)
+	ch, err := p.acquire(ctx)
+	if err != nil {
+		done(err)
+		return err
+	}
+	defer p.release(ch)
+	err = ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+	done(err)
+	return err
+}
+
+func (p *Publisher) PublishConfirmed(ctx context.Context, codec Codec, exchange, key string, val any, opts ...PublishOption) error {
+	msg, err := p.newPublishing(codec, exchange, key, val, opts)
+	if err != nil {
+		return err
+	}
+	return p.publishConfirmed(ctx, exchange, key, msg)
+}
+
+func (p *Publisher) publishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	done := instrumentPublish(ctx, exchange, key, &msg)
+	ch, err := p.acquire(ctx)
+	if err != nil {
+		done(err)
+		return err
+	}
+	defer p.release(ch)
+	err = publishConfirmed(ctx, ch, exchange, key, msg, p.confirmTimeout)
+	done(err)
+	return err
+}
+
+func (p *Publisher) newPublishing(codec Codec, exchange, key string, val any, opts []PublishOption) (amqp.Publishing, error) {
+	msg, err := newPublishing(codec, val, p.sender, opts)
+	if err != nil {
+		return msg, err
+	}
+	if err := compress(&msg, p.compression, p.compressionThreshold); err != nil {
+		return msg, fmt.Errorf("error compressing message: %w", err)
+	}
+	if p.signingKey != nil {
+		sign(&msg, exchange, key, p.signingKey, p.certificate)
+	}
+	return msg, nil
+}
+
+// Close closes the idle channels. Channels in use are closed as they are
+// released.
+func (p *Publisher) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
 	})
+	for {
+		select {
+		case ch := <-p.idle:
+			ch.Close()
+			<-p.open
+		default:
+			return nil
+		}
+	}
+}
+
+func (p *Publisher) acquire(ctx context.Context) (Channel, error) {
+	for {
+		select {
+		case <-p.closed:
+			return nil, ErrPublisherClosed
+		default:
+		}
+		var ch Channel
+		select {
+		case ch = <-p.idle:
+		default:
+			select {
+			case ch = <-p.idle:
+			case p.open <- struct{}{}:
+				newCh, err := p.broker.Channel(ctx)
+				if err != nil {
+					<-p.open
+					return nil, err
+				}
+				if err := newCh.Confirm(false); err != nil {
+					newCh.Close()
+					<-p.open
+					return nil, fmt.Errorf("error enabling publisher confirms: %s", err)
+				}
+				return newCh, nil
+			case <-p.closed:
+				return nil, ErrPublisherClosed
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if !ch.IsClosed() {
+			return ch, nil
+		}
+		<-p.open
+	}
+}
+
+func (p *Publisher) release(ch Channel) {
+	if ch.IsClosed() {
+		<-p.open
+		return
+	}
+	p.idle <- ch
+	select {
+	case <-p.closed:
+		p.Close()
+	default:
+	}
 }
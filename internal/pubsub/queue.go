@@ -1,8 +1,11 @@
 package pubsub
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -11,31 +14,55 @@ type SimpleQueueType uint8
 const (
 	DurableQueue SimpleQueueType = iota
 	TransientQueue
+	// QuorumQueue is a replicated durable queue, the recommended durable
+	// type on RabbitMQ 4.
+	QuorumQueue
+	// StreamQueue is an append-only log that keeps messages after they are
+	// consumed, so consumers can replay it from an offset. Streams do not
+	// dead-letter.
+	StreamQueue
 )
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
+	ch, err := b.Channel(ctx)
 	if err != nil {
-		return nil, amqp.Queue{}, fmt.Errorf("failed to create channel: %s", err)
+		return nil, amqp.Queue{}, fmt.Errorf("failed to create channel: %w", err)
 	}
-	isDurable, isAutoDelete, isExclusive := getQueueOptionsForType(queueType)
-	q, err := ch.QueueDeclare(queueName, isDurable, isAutoDelete, isExclusive, false, amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
+	q, err := declareAndBind(ch, exchange, queueName, key, queueType, opts)
+	if err != nil {
+		ch.Close()
+		return nil, q, err
+	}
+	remember(b, fmt.Sprintf("queue %s bound to %s with key %s", queueName, exchange, key), func(ch Channel) error {
+		_, err := declareAndBind(ch, exchange, queueName, key, queueType, opts)
+		return err
 	})
+	return ch, q, nil
+}
+
+func declareAndBind(ch Channel, exchange, queueName, key string, queueType SimpleQueueType, opts []QueueOption) (amqp.Queue, error) {
+	isDurable, isAutoDelete, isExclusive := getQueueOptionsForType(queueType)
+	args := getQueueArgsForType(queueType)
+	for _, opt := range opts {
+		opt(args)
+	}
+	q, err := ch.QueueDeclare(queueName, isDurable, isAutoDelete, isExclusive, false, args)
 	if err != nil {
-		return nil, q, fmt.Errorf("failed to create queue: %s", err)
+		return q, fmt.Errorf("failed to create queue: %s", err)
 	}
 	err = ch.QueueBind(q.Name, key, exchange, false, nil)
 	if err != nil {
-		return nil, q, fmt.Errorf("failed to bind queue: %s", err)
+		return q, fmt.Errorf("failed to bind queue: %s", err)
 	}
-	return ch, q, nil
+	return q, nil
 }
 
 func getQueueOptionsForType(queueType SimpleQueueType) (isDurable, isAutoDelete, isExclusive bool) {
@@ -45,6 +72,25 @@ func getQueueOptionsForType(queueType SimpleQueueType) (isDurable, isAutoDelete,
 	case TransientQueue:
 		isAutoDelete = true
 		isExclusive = true
+	case QuorumQueue, StreamQueue:
+		isDurable = true
 	}
 	return
 }
+
+func getQueueArgsForType(queueType SimpleQueueType) amqp.Table {
+	switch queueType {
+	case QuorumQueue:
+		return amqp.Table{
+			amqp.QueueTypeArg:        amqp.QueueTypeQuorum,
+			"x-dead-letter-exchange": routing.ExchangePerilDLX,
+		}
+	case StreamQueue:
+		return amqp.Table{
+			amqp.QueueTypeArg: amqp.QueueTypeStream,
+		}
+	}
+	return amqp.Table{
+		"x-dead-letter-exchange": routing.ExchangePerilDLX,
+	}
+}
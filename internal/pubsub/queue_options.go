@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// QueueOption sets an argument of a queue when it is declared. RabbitMQ
+// refuses to redeclare an existing queue with different arguments, so
+// changing the options of a durable queue means deleting it first.
+type QueueOption func(amqp.Table)
+
+// Overflow is what a queue does with new messages once it is full.
+type Overflow string
+
+const (
+	// OverflowDropHead drops, or dead-letters, the oldest messages to make
+	// room. This is RabbitMQ's default.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish rejects new messages; publishers using
+	// confirms see them nacked.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX rejects new messages and dead-letters them.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// WithMessageTTL expires messages that stayed in the queue for longer than
+// ttl. Expired messages are dead-lettered.
+func WithMessageTTL(ttl time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-message-ttl"] = ttl.Milliseconds()
+	}
+}
+
+// WithQueueExpiry deletes the queue once it has had no consumers, and has
+// not been redeclared, for d.
+func WithQueueExpiry(d time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-expires"] = d.Milliseconds()
+	}
+}
+
+// WithMaxLength caps how many ready messages the queue holds.
+func WithMaxLength(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-length"] = int64(n)
+	}
+}
+
+// WithMaxLengthBytes caps the total body size of the ready messages the
+// queue holds.
+func WithMaxLengthBytes(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-length-bytes"] = int64(n)
+	}
+}
+
+// WithOverflow sets what the queue does once it reaches its maximum length.
+func WithOverflow(overflow Overflow) QueueOption {
+	return func(args amqp.Table) {
+		args["x-overflow"] = string(overflow)
+	}
+}
+
+// WithDeadLetterRoutingKey dead-letters messages with key instead of the
+// routing key they were published with.
+func WithDeadLetterRoutingKey(key string) QueueOption {
+	return func(args amqp.Table) {
+		args["x-dead-letter-routing-key"] = key
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with opts.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queueOptions = append(o.queueOptions, opts...)
+	}
+}
@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderRetryAttempts counts how many times a message has been retried. It is
+// kept by the subscriber rather than derived from x-death, which RabbitMQ
+// does not let clients republish.
+const HeaderRetryAttempts = "x-retry-attempts"
+
+// RetryPolicy turns NackRequeue into a delayed retry. The n-th retry of a
+// message waits InitialDelay*2^(n-1), capped at MaxDelay, in a retry queue
+// whose TTL dead-letters it back to the queue it came from. Once a message
+// has been retried MaxAttempts times it is nacked into the dead-letter queue.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for range attempt {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+func (p RetryPolicy) delays() []time.Duration {
+	var delays []time.Duration
+	for attempt := range p.MaxAttempts {
+		delay := p.delay(attempt)
+		if len(delays) == 0 || delays[len(delays)-1] != delay {
+			delays = append(delays, delay)
+		}
+	}
+	return delays
+}
+
+func retryName(delay time.Duration) string {
+	return fmt.Sprintf("%s.%s", routing.RetryPrefix, delay)
+}
+
+func declareRetryTopology(ctx context.Context, b Broker, policy RetryPolicy) error {
+	ch, err := b.Channel(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %s", err)
+	}
+	defer ch.Close()
+	for _, delay := range policy.delays() {
+		declare := func(ch Channel) error {
+			return declareRetryQueue(ch, delay)
+		}
+		if err := declare(ch); err != nil {
+			return err
+		}
+		remember(b, retryName(delay), declare)
+	}
+	return nil
+}
+
+// declareRetryQueue declares a fanout exchange and a queue holding messages
+// for delay. Expired messages are dead-lettered to the default exchange with
+// their routing key, which retry sets to the name of the origin queue.
+func declareRetryQueue(ch Channel, delay time.Duration) error {
+	name := retryName(delay)
+	err := ch.ExchangeDeclare(name, amqp.ExchangeFanout, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %s", name, err)
+	}
+	_, err = ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":          delay.Milliseconds(),
+		"x-dead-letter-exchange": "",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create queue %s: %s", name, err)
+	}
+	err = ch.QueueBind(name, "", name, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s: %s", name, err)
+	}
+	return nil
+}
+
+func (c *consumer[T]) retry(ctx context.Context, msg amqp.Delivery) {
+	policy := c.options.retry
+	attempts := headerInt(msg.Headers, HeaderRetryAttempts)
+	if attempts >= policy.MaxAttempts {
+		c.log.Warn("giving up on message", "message_id", msg.MessageId, "attempts", attempts)
+		msg.Nack(false, false)
+		return
+	}
+	delay := policy.delay(attempts)
+	pub := republishing(msg)
+	recordOriginalRoute(pub.Headers, msg)
+	pub.Headers[HeaderRetryAttempts] = int32(attempts + 1)
+	if err := c.republish(ctx, retryName(delay), c.queueName, pub); err != nil {
+		c.log.Error("error scheduling retry, requeuing message instead", "message_id", msg.MessageId, "error", err)
+		msg.Nack(false, true)
+		return
+	}
+	c.log.Info("retrying message", "message_id", msg.MessageId, "attempt", attempts+1, "delay", delay)
+	msg.Ack(false)
+}
@@ -0,0 +1,142 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// directReplyTo is RabbitMQ's pseudo-queue for replies. Consuming from it
+// in no-ack mode lets a channel receive replies without declaring a queue.
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+const HeaderRPCError = "x-rpc-error"
+
+var ErrNoResponder = errors.New("no queue is bound to receive the request")
+
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error: %s", e.Message)
+}
+
+// Call publishes req and waits for the reply of a Serve handler until ctx is
+// done. The remaining time until ctx's deadline, if any, becomes the
+// request's expiration so it is not served after the caller gave up.
+func Call[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	codec Codec,
+	exchange,
+	key string,
+	req Req,
+	opts ...PublishOption,
+) (Resp, error) {
+	var resp Resp
+	msg, err := newPublishing(codec, req, "", opts)
+	if err != nil {
+		return resp, err
+	}
+	msg.ReplyTo = directReplyTo
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+
+	ch, err := b.Channel(ctx)
+	if err != nil {
+		return resp, fmt.Errorf("failed to create channel: %s", err)
+	}
+	defer ch.Close()
+	replies, err := ch.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		return resp, fmt.Errorf("error consuming replies: %s", err)
+	}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	done := instrumentPublish(ctx, exchange, key, &msg)
+	err = ch.PublishWithContext(ctx, exchange, key, true, false, msg)
+	done(err)
+	if err != nil {
+		return resp, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case _, ok := <-returns:
+			if !ok {
+				return resp, ErrConnectionClosed
+			}
+			return resp, ErrNoResponder
+		case reply, ok := <-replies:
+			if !ok {
+				return resp, ErrConnectionClosed
+			}
+			if envelopeFromDelivery(ctx, reply).CausationID != msg.MessageId {
+				continue
+			}
+			if remoteErr, ok := reply.Headers[HeaderRPCError].(string); ok {
+				return resp, &RemoteError{Message: remoteErr}
+			}
+			replyCodec, ok := CodecFor(reply.ContentType)
+			if !ok {
+				replyCodec = codec
+			}
+			body, err := decompress(reply.ContentEncoding, reply.Body)
+			if err != nil {
+				return resp, fmt.Errorf("error decompressing reply: %w", err)
+			}
+			return routing.DecodeSchema[Resp](schemaVersion(reply.Headers), func(v any) error {
+				return replyCodec.Unmarshal(body, v)
+			})
+		}
+	}
+}
+
+// Serve answers requests sent with Call on queueName. An error returned by
+// handler is sent back to the caller as a RemoteError.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	codec Codec,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Req, Envelope) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	pub := NewPublisher(b)
+	sub, err := Subscribe(ctx, b, codec, exchange, queueName, key, queueType, func(req Req, env Envelope) AckType {
+		if env.ReplyTo == "" {
+			logger().Warn("discarding request without reply-to", "queue", queueName, "message_id", env.MessageID)
+			return NackDiscard
+		}
+		resp, err := handler(req, env)
+		replyOpts := []PublishOption{CausedBy(env)}
+		if err != nil {
+			replyOpts = append(replyOpts, WithHeader(HeaderRPCError, err.Error()))
+		}
+		if err := pub.Publish(ctx, codec, "", env.ReplyTo, resp, replyOpts...); err != nil {
+			logger().Error("error replying to request", "queue", queueName, "message_id", env.MessageID, "error", err)
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		pub.Close()
+		return nil, err
+	}
+	go func() {
+		<-sub.Done()
+		pub.Close()
+	}()
+	return sub, nil
+}
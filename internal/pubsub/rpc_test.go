@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCallNoResponder(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	defer b.Close()
+	if err := DeclareExchanges(ctx, b, Exchange{Name: "ex", Kind: amqp.ExchangeDirect}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Call[string, string](ctx, b, JSON, "ex", "nobody", "hi")
+	if !errors.Is(err, ErrNoResponder) {
+		t.Errorf("Call with no queue bound returned %v, want ErrNoResponder", err)
+	}
+}
+
+func TestCallConnectionClosed(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	if err := DeclareExchanges(ctx, b, Exchange{Name: "ex", Kind: amqp.ExchangeDirect}); err != nil {
+		t.Fatal(err)
+	}
+	// The request is queued but never served.
+	ch, _ := b.Channel(ctx)
+	ch.QueueDeclare("requests", false, false, false, false, nil)
+	ch.QueueBind("requests", "requests", "ex", false, nil)
+	time.AfterFunc(50*time.Millisecond, func() { b.Close() })
+	_, err := Call[string, string](ctx, b, JSON, "ex", "requests", "hi")
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Call interrupted by a closed connection returned %v, want ErrConnectionClosed", err)
+	}
+}
@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Version 1 of player had a single name, version 2 split it in two and
+// version 3, the current one, added a score.
+type playerV1 struct {
+	Name string
+}
+
+type playerV2 struct {
+	First string
+	Last  string
+}
+
+type player struct {
+	First string
+	Last  string
+	Score int
+}
+
+func init() {
+	routing.RegisterSchema[player](3)
+	routing.RegisterUpcaster[player](1, func(p playerV1) (playerV2, error) {
+		first, last, _ := strings.Cut(p.Name, " ")
+		return playerV2{First: first, Last: last}, nil
+	})
+	routing.RegisterUpcaster[player](2, func(p playerV2) (player, error) {
+		return player{First: p.First, Last: p.Last, Score: 100}, nil
+	})
+}
+
+func TestSubscribeUpcastsOlderSchemas(t *testing.T) {
+	tests := []struct {
+		name string
+		val  any
+		want player
+	}{
+		{"v1", playerV1{Name: "Ada Lovelace"}, player{First: "Ada", Last: "Lovelace", Score: 100}},
+		{"v2", playerV2{First: "Ada", Last: "Lovelace"}, player{First: "Ada", Last: "Lovelace", Score: 100}},
+		{"current", player{First: "Ada", Last: "Lovelace", Score: 7}, player{First: "Ada", Last: "Lovelace", Score: 7}},
+	}
+	for _, codec := range []Codec{JSON, Gob, MsgPack, CBOR} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			ctx := context.Background()
+			b := NewMemoryBroker()
+			defer b.Close()
+			if err := DeclareExchanges(ctx, b, Exchange{Name: "ex", Kind: amqp.ExchangeDirect}); err != nil {
+				t.Fatal(err)
+			}
+			handled := make(chan player, 1)
+			sub, err := Subscribe(ctx, b, codec, "ex", "players", "players", TransientQueue, func(p player, _ Envelope) AckType {
+				handled <- p
+				return Ack
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			pub := NewPublisher(b)
+			defer pub.Close()
+
+			for version, tt := range tests {
+				err := pub.PublishConfirmed(ctx, codec, "ex", "players", tt.val, WithHeader(HeaderSchemaVersion, int32(version+1)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case got := <-handled:
+					if got != tt.want {
+						t.Errorf("%s payload decoded as %+v, want %+v", tt.name, got, tt.want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("%s payload was not handled", tt.name)
+				}
+			}
+		})
+	}
+}
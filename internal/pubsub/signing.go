@@ -0,0 +1,328 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderSignature = "x-signature"
+	// HeaderSignerKey and HeaderSignerCertificate carry the public key a
+	// message is signed with and the authority's certificate binding it to
+	// the sender.
+	HeaderSignerKey         = "x-signer-key"
+	HeaderSignerCertificate = "x-signer-certificate"
+)
+
+var (
+	ErrForgedMessage      = errors.New("message signature is missing or invalid")
+	ErrKeyClaimed         = errors.New("sender claimed with another key")
+	ErrInvalidPublicKey   = errors.New("invalid public key")
+	ErrInvalidCertificate = errors.New("certificate is not signed by the authority")
+)
+
+// certificateDomain prefixes what certificates sign, so that no message
+// signature can pass for one.
+const certificateDomain = "peril certificate v1"
+
+// Certificate binds a sender to the public key it signs messages with. It is
+// valid if it is signed by the authority subscribers trust.
+type Certificate struct {
+	Sender    string
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+// Verify checks that the certificate is signed by authority.
+func (c Certificate) Verify(authority ed25519.PublicKey) error {
+	if len(c.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(authority, c.payload(), c.Signature) {
+		return ErrInvalidCertificate
+	}
+	return nil
+}
+
+func (c Certificate) payload() []byte {
+	return appendFields(nil, certificateDomain, c.Sender, string(c.PublicKey))
+}
+
+// WithSigningKey signs every message with key, the publisher's own private
+// key, and attaches cert, its certificate from an Authority. The signature
+// covers the body as sent along with the exchange and routing key it is
+// published to, the sender, message ID, timestamp, content type and
+// encoding, and schema version.
+func WithSigningKey(key ed25519.PrivateKey, cert Certificate) PublisherOption {
+	return func(p *Publisher) {
+		p.signingKey = key
+		p.certificate = cert
+	}
+}
+
+func sign(msg *amqp.Publishing, exchange, routingKey string, key ed25519.PrivateKey, cert Certificate) {
+	payload := signedPayload(msg.Headers, exchange, routingKey, msg.MessageId, msg.Timestamp, msg.ContentType, msg.ContentEncoding, msg.Body)
+	msg.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	msg.Headers[HeaderSignerKey] = base64.StdEncoding.EncodeToString(cert.PublicKey)
+	msg.Headers[HeaderSignerCertificate] = base64.StdEncoding.EncodeToString(cert.Signature)
+}
+
+// signedPayload serializes what a signature covers. The timestamp is taken
+// in seconds, the precision AMQP carries it with.
+func signedPayload(headers amqp.Table, exchange, routingKey, messageID string, timestamp time.Time, contentType, contentEncoding string, body []byte) []byte {
+	sender, _ := headers[HeaderSender].(string)
+	return appendFields(nil,
+		exchange,
+		routingKey,
+		sender,
+		messageID,
+		fmt.Sprint(timestamp.Unix()),
+		contentType,
+		contentEncoding,
+		fmt.Sprint(schemaVersion(headers)),
+		string(body),
+	)
+}
+
+// appendFields appends each field prefixed with its length, so that no two
+// lists of fields serialize alike.
+func appendFields(payload []byte, fields ...string) []byte {
+	for _, field := range fields {
+		payload = binary.AppendUvarint(payload, uint64(len(field)))
+		payload = append(payload, field...)
+	}
+	return payload
+}
+
+// keyClaim is one line of an authority's claim store.
+type keyClaim struct {
+	Sender    string            `json:"sender"`
+	PublicKey ed25519.PublicKey `json:"public_key"`
+}
+
+// Authority certifies the public keys senders sign messages with. Its own
+// key is derived from a secret, so authorities sharing it issue
+// certificates the same subscribers trust. A sender is claimed by the first
+// public key certified for it, and only that key is certified for it again.
+type Authority struct {
+	key ed25519.PrivateKey
+	mu  sync.Mutex
+	// claims maps each claimed sender to its public key.
+	claims map[string]ed25519.PublicKey
+	store  *os.File
+}
+
+// NewAuthority keeps claims in memory, so they are forgotten when the
+// process exits.
+func NewAuthority(secret []byte) *Authority {
+	seed := sha256.Sum256(secret)
+	return &Authority{
+		key:    ed25519.NewKeyFromSeed(seed[:]),
+		claims: map[string]ed25519.PublicKey{},
+	}
+}
+
+// OpenAuthority is like NewAuthority, but also records claims in the file at
+// path so that senders stay claimed across restarts. Authorities may share
+// the file; claims are recorded under an exclusive lock on it.
+func OpenAuthority(secret []byte, path string) (*Authority, error) {
+	a := NewAuthority(secret)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open claim store: %w", err)
+	}
+	a.store = f
+	if err := a.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// PublicKey returns the key certificates are verified with.
+func (a *Authority) PublicKey() ed25519.PublicKey {
+	return a.key.Public().(ed25519.PublicKey)
+}
+
+func (a *Authority) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store == nil {
+		return nil
+	}
+	err := a.store.Close()
+	a.store = nil
+	return err
+}
+
+// load reads the claims in the store, including those other processes
+// sharing it have recorded since it was opened.
+func (a *Authority) load() error {
+	if _, err := a.store.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not read claim store: %w", err)
+	}
+	scanner := bufio.NewScanner(a.store)
+	for scanner.Scan() {
+		var claim keyClaim
+		if err := json.Unmarshal(scanner.Bytes(), &claim); err != nil {
+			return fmt.Errorf("could not read claim store: %w", err)
+		}
+		if _, ok := a.claims[claim.Sender]; !ok {
+			a.claims[claim.Sender] = claim.PublicKey
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read claim store: %w", err)
+	}
+	return nil
+}
+
+// Certify returns a certificate binding sender to key if key claims sender,
+// either because sender was unclaimed or because it was claimed with the
+// same key.
+func (a *Authority) Certify(sender string, key ed25519.PublicKey) (Certificate, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return Certificate{}, fmt.Errorf("%w: must be %d bytes", ErrInvalidPublicKey, ed25519.PublicKeySize)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.claim(sender, key); err != nil {
+		return Certificate{}, err
+	}
+	cert := Certificate{Sender: sender, PublicKey: key}
+	cert.Signature = ed25519.Sign(a.key, cert.payload())
+	return cert, nil
+}
+
+func (a *Authority) claim(sender string, key ed25519.PublicKey) error {
+	if a.store != nil {
+		// Another process sharing the store may have claimed sender since
+		// it was last read, so it is read again under the lock before
+		// recording a claim.
+		unlock, err := lockFile(a.store)
+		if err != nil {
+			return fmt.Errorf("could not lock claim store: %w", err)
+		}
+		defer unlock()
+		if _, ok := a.claims[sender]; !ok {
+			if err := a.load(); err != nil {
+				return err
+			}
+		}
+	}
+	if claimed, ok := a.claims[sender]; ok {
+		if !bytes.Equal(claimed, key) {
+			return fmt.Errorf("%w for '%s'", ErrKeyClaimed, sender)
+		}
+		return nil
+	}
+	if a.store != nil {
+		line, err := json.Marshal(keyClaim{Sender: sender, PublicKey: key})
+		if err != nil {
+			return err
+		}
+		if _, err := a.store.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("could not record claim: %w", err)
+		}
+		if err := a.store.Sync(); err != nil {
+			return fmt.Errorf("could not record claim: %w", err)
+		}
+	}
+	a.claims[sender] = key
+	return nil
+}
+
+// defaultMaxMessageAge is how old a signed message may be before a
+// verified subscription stops trusting it.
+const defaultMaxMessageAge = 15 * time.Minute
+
+// WithVerifier discards deliveries that are not signed with a key certified
+// by authority for their sender, without handling them, and passes them to
+// onForgery if it is not nil.
+//
+// To stop signed messages from being replayed, deliveries signed for an
+// exchange or routing key the subscription is not bound to count as forged,
+// those older than the maximum message age are discarded, and the
+// subscription is deduplicated if it is not already.
+func WithVerifier(authority ed25519.PublicKey, onForgery func(Envelope, error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.verifier = authority
+		o.onForgery = onForgery
+	}
+}
+
+// WithMaxMessageAge sets how old, by its timestamp, a signed message may be
+// before WithVerifier discards it. It defaults to 15 minutes.
+func WithMaxMessageAge(age time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.maxMessageAge = age
+	}
+}
+
+// verifySignature checks that msg is signed for the route it took by a key
+// certified for its sender.
+func verifySignature(msg amqp.Delivery, exchange, routingKey string, authority ed25519.PublicKey) error {
+	var fields [3][]byte
+	for i, header := range []string{HeaderSignature, HeaderSignerKey, HeaderSignerCertificate} {
+		encoded, _ := msg.Headers[header].(string)
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if encoded == "" || err != nil {
+			return ErrForgedMessage
+		}
+		fields[i] = decoded
+	}
+	signature, key, certSignature := fields[0], ed25519.PublicKey(fields[1]), fields[2]
+	sender, _ := msg.Headers[HeaderSender].(string)
+	if sender == "" {
+		return ErrForgedMessage
+	}
+	cert := Certificate{Sender: sender, PublicKey: key, Signature: certSignature}
+	if err := cert.Verify(authority); err != nil {
+		return fmt.Errorf("%w: %s", ErrForgedMessage, err)
+	}
+	payload := signedPayload(msg.Headers, exchange, routingKey, msg.MessageId, msg.Timestamp, msg.ContentType, msg.ContentEncoding, msg.Body)
+	if !ed25519.Verify(key, payload, signature) {
+		return ErrForgedMessage
+	}
+	return nil
+}
+
+// verify reports whether msg is authentic and fresh, settling it if it is
+// not.
+func (c *consumer[T]) verify(ctx context.Context, msg amqp.Delivery) bool {
+	env := envelopeFromDelivery(ctx, msg)
+	err := ErrForgedMessage
+	exchange, routingKey := originalRoute(msg)
+	if exchange == c.exchange && topicMatch(c.bindingKey, routingKey) {
+		err = verifySignature(msg, exchange, routingKey, c.options.verifier)
+	}
+	if err != nil {
+		c.log.Warn("discarding forged message", "message_id", msg.MessageId, "routing_key", msg.RoutingKey, "username", env.Sender, "error", err)
+		outcomesTotal.WithLabelValues(c.queueName, outcomeForged).Inc()
+		msg.Nack(false, false)
+		if c.options.onForgery != nil {
+			c.options.onForgery(env, err)
+		}
+		return false
+	}
+	maxAge := cmp.Or(c.options.maxMessageAge, defaultMaxMessageAge)
+	if age := time.Since(msg.Timestamp); age > maxAge || age < -maxAge {
+		c.log.Warn("discarding stale signed message", "message_id", msg.MessageId, "username", env.Sender, "age", age)
+		outcomesTotal.WithLabelValues(c.queueName, outcomeStale).Inc()
+		msg.Nack(false, false)
+		return false
+	}
+	return true
+}
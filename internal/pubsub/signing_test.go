@@ -0,0 +1,281 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// verifiedSub subscribes to "ex" with key "moves.*", verifying signatures
+// certified by authority.
+type verifiedSub struct {
+	ch      Channel
+	handled chan greeting
+	forged  chan Envelope
+}
+
+func newVerifiedSub(t *testing.T, b Broker, authority ed25519.PublicKey) *verifiedSub {
+	t.Helper()
+	ctx := context.Background()
+	if err := DeclareExchanges(ctx, b, Exchange{Name: "ex", Kind: amqp.ExchangeTopic}); err != nil {
+		t.Fatal(err)
+	}
+	s := &verifiedSub{handled: make(chan greeting, 10), forged: make(chan Envelope, 10)}
+	sub, err := Subscribe(ctx, b, JSON, "ex", "moves", "moves.*", TransientQueue, func(g greeting, _ Envelope) AckType {
+		s.handled <- g
+		return Ack
+	}, WithVerifier(authority, func(env Envelope, _ error) { s.forged <- env }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	s.ch, err = b.Channel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (s *verifiedSub) publish(t *testing.T, key string, msg amqp.Publishing) {
+	t.Helper()
+	publishTest(t, s.ch, "ex", key, msg)
+}
+
+func (s *verifiedSub) expectHandled(t *testing.T, text string) {
+	t.Helper()
+	select {
+	case g := <-s.handled:
+		if g.Text != text {
+			t.Errorf("handled %q, want %q", g.Text, text)
+		}
+	case <-time.After(deliveryTimeout):
+		t.Fatalf("%q was not handled", text)
+	}
+}
+
+func (s *verifiedSub) expectForged(t *testing.T) {
+	t.Helper()
+	select {
+	case g := <-s.handled:
+		t.Fatalf("forged message %q was handled", g.Text)
+	case <-s.forged:
+	case <-time.After(deliveryTimeout):
+		t.Fatal("forged message was not reported")
+	}
+}
+
+func (s *verifiedSub) expectDiscarded(t *testing.T) {
+	t.Helper()
+	select {
+	case g := <-s.handled:
+		t.Fatalf("message %q was handled, want it discarded", g.Text)
+	case env := <-s.forged:
+		t.Fatalf("message %s was reported forged, want it discarded", env.MessageID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// newSigner returns a publisher for sender signing with a key certified by
+// authority for certified.
+func newSigner(t *testing.T, b Broker, authority *Authority, sender, certified string) *Publisher {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := authority.Certify(certified, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := NewPublisher(b, WithSender(sender), WithSigningKey(private, cert))
+	t.Cleanup(func() { pub.Close() })
+	return pub
+}
+
+func signedMessage(t *testing.T, pub *Publisher, key, text string, opts ...PublishOption) amqp.Publishing {
+	t.Helper()
+	msg, err := pub.newPublishing(JSON, "ex", key, greeting{Text: text}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestVerifierAcceptsSignedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	authority := NewAuthority([]byte("secret"))
+	s := newVerifiedSub(t, b, authority.PublicKey())
+	pub := newSigner(t, b, authority, "alice", "alice")
+	if err := pub.PublishConfirmed(context.Background(), JSON, "ex", "moves.alice", greeting{Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	s.expectHandled(t, "hi")
+}
+
+func TestVerifierDiscardsForgedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	authority := NewAuthority([]byte("secret"))
+	s := newVerifiedSub(t, b, authority.PublicKey())
+	alice := newSigner(t, b, authority, "alice", "alice")
+
+	tests := []struct {
+		name string
+		msg  func() amqp.Publishing
+	}{
+		{"unsigned", func() amqp.Publishing {
+			msg, _ := newPublishing(JSON, greeting{Text: "hi"}, "alice", nil)
+			return msg
+		}},
+		{"tampered body", func() amqp.Publishing {
+			msg := signedMessage(t, alice, "moves.alice", "hi")
+			msg.Body = []byte(`{"Text":"bye"}`)
+			return msg
+		}},
+		{"tampered sender", func() amqp.Publishing {
+			msg := signedMessage(t, alice, "moves.alice", "hi")
+			msg.Headers[HeaderSender] = "bob"
+			return msg
+		}},
+		{"certified for another sender", func() amqp.Publishing {
+			return signedMessage(t, newSigner(t, b, authority, "bob", "mallory"), "moves.alice", "hi")
+		}},
+		{"certified by another authority", func() amqp.Publishing {
+			return signedMessage(t, newSigner(t, b, NewAuthority([]byte("other")), "alice", "alice"), "moves.alice", "hi")
+		}},
+		{"signed for another routing key", func() amqp.Publishing {
+			return signedMessage(t, alice, "moves.bob", "hi")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.publish(t, "moves.alice", tt.msg())
+			s.expectForged(t)
+		})
+	}
+}
+
+func TestVerifierDiscardsReplayedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	authority := NewAuthority([]byte("secret"))
+	s := newVerifiedSub(t, b, authority.PublicKey())
+	msg := signedMessage(t, newSigner(t, b, authority, "alice", "alice"), "moves.alice", "hi")
+	s.publish(t, "moves.alice", msg)
+	s.expectHandled(t, "hi")
+	s.publish(t, "moves.alice", msg)
+	s.expectDiscarded(t)
+}
+
+func TestVerifierDiscardsStaleMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	authority := NewAuthority([]byte("secret"))
+	s := newVerifiedSub(t, b, authority.PublicKey())
+	pub := newSigner(t, b, authority, "alice", "alice")
+	for _, age := range []time.Duration{defaultMaxMessageAge + time.Minute, -defaultMaxMessageAge - time.Minute} {
+		msg := signedMessage(t, pub, "moves.alice", "hi", func(msg *amqp.Publishing) {
+			msg.Timestamp = time.Now().Add(-age)
+		})
+		s.publish(t, "moves.alice", msg)
+		s.expectDiscarded(t)
+	}
+}
+
+func TestAuthorityFirstClaimWins(t *testing.T) {
+	a := NewAuthority([]byte("secret"))
+	first, _, _ := ed25519.GenerateKey(nil)
+	second, _, _ := ed25519.GenerateKey(nil)
+	cert, err := a.Certify("alice", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(a.PublicKey()); err != nil {
+		t.Errorf("certificate does not verify: %v", err)
+	}
+	if _, err := a.Certify("alice", first); err != nil {
+		t.Errorf("certifying the claiming key again returned %v", err)
+	}
+	if _, err := a.Certify("alice", second); !errors.Is(err, ErrKeyClaimed) {
+		t.Errorf("certifying another key returned %v, want ErrKeyClaimed", err)
+	}
+	if _, err := a.Certify("bob", first[:10]); !errors.Is(err, ErrInvalidPublicKey) {
+		t.Errorf("certifying a short key returned %v, want ErrInvalidPublicKey", err)
+	}
+}
+
+func TestAuthorityKeepsClaimsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "claims.jsonl")
+	key, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	a, err := OpenAuthority([]byte("secret"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Certify("alice", key); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	a, err = OpenAuthority([]byte("secret"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err := a.Certify("alice", other); !errors.Is(err, ErrKeyClaimed) {
+		t.Errorf("certifying another key after reopening returned %v, want ErrKeyClaimed", err)
+	}
+	if _, err := a.Certify("alice", key); err != nil {
+		t.Errorf("certifying the claiming key after reopening returned %v", err)
+	}
+}
+
+func TestAuthoritiesSharingAStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "claims.jsonl")
+	const authorities, senders = 4, 100
+	var wg sync.WaitGroup
+	claims := make([]int, senders)
+	var mu sync.Mutex
+	for range authorities {
+		a, err := OpenAuthority([]byte("secret"), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range senders {
+				key, _, _ := ed25519.GenerateKey(nil)
+				if _, err := a.Certify(fmt.Sprint("player", n), key); err == nil {
+					mu.Lock()
+					claims[n]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for n, count := range claims {
+		if count != 1 {
+			t.Errorf("player%d claimed by %d authorities, want 1", n, count)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != senders {
+		t.Errorf("store holds %d claims, want %d", lines, senders)
+	}
+}
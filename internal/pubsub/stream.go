@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// streamOffsetArg is both the consumer argument that sets where a stream
+// consumer starts and the header carrying each delivery's offset.
+const streamOffsetArg = "x-stream-offset"
+
+// StreamOffset is where a subscription to a StreamQueue starts reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	StreamFirst = StreamOffset{value: "first"}
+	StreamLast  = StreamOffset{value: "last"}
+	StreamNext  = StreamOffset{value: "next"}
+)
+
+// StreamOffsetAt starts at the message with the given offset.
+func StreamOffsetAt(offset int64) StreamOffset {
+	return StreamOffset{value: offset}
+}
+
+// StreamOffsetSince starts at the first chunk of messages written at or
+// after t, so a few earlier messages may be delivered too.
+func StreamOffsetSince(t time.Time) StreamOffset {
+	return StreamOffset{value: t}
+}
+
+// WithStreamOffset sets where a subscription to a StreamQueue starts. By
+// default it only receives messages published after it subscribed. Either
+// way, after losing its consumer it resumes right after the last message
+// it received.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.streamOffset = &offset
+	}
+}
+
+// consumeArgs returns the consumer arguments to start or resume consuming
+// with.
+func (c *consumer[T]) consumeArgs() amqp.Table {
+	if last := c.lastOffset.Load(); last >= 0 {
+		return amqp.Table{streamOffsetArg: last + 1}
+	}
+	if c.options.streamOffset != nil {
+		return amqp.Table{streamOffsetArg: c.options.streamOffset.value}
+	}
+	return nil
+}
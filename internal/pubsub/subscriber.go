@@ -1,11 +1,20 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -18,84 +27,399 @@ const (
 	NackDiscard
 )
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack_requeue"
+	case NackDiscard:
+		return "nack_discard"
+	}
+	return fmt.Sprintf("AckType(%d)", uint8(a))
+}
+
+var errClosedByCaller = errors.New("subscription closed")
+
+type Subscription struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	err    error
+}
+
+// Close stops consuming and waits for the in-flight delivery, if any, to be
+// handled. Unacked messages are returned to the queue by the broker.
+func (s *Subscription) Close() error {
+	s.cancel(errClosedByCaller)
+	<-s.done
+	return s.err
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns nil while the subscription is running or after Close, and the
+// reason it stopped otherwise.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+const defaultPrefetch = 10
+
+type subscribeOptions struct {
+	prefetch            int
+	workers             int
+	orderingKey         func(amqp.Delivery) string
+	decodeByContentType bool
+	decodeFailure       decodeFailurePolicy
+	decodeRequeueLimit  int
+	retry               *RetryPolicy
+	dedup               *Deduplicator
+	verifier            ed25519.PublicKey
+	onForgery           func(Envelope, error)
+	maxMessageAge       time.Duration
+	logger              *slog.Logger
+	streamOffset        *StreamOffset
+	queueOptions        []QueueOption
+	middleware          []any
+}
+
+func WithPrefetch(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = count
+	}
+}
+
+// WithWorkers handles up to count deliveries in parallel. Each delivery is
+// acked or nacked as soon as its own handler returns.
+func WithWorkers(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.workers = max(count, 1)
+	}
+}
+
+// WithOrderingKey keeps deliveries that share a key on the same worker, so
+// they are handled one at a time and in the order they were delivered.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// DecodeByContentType picks the decoder for each delivery from the codec
+// registry based on its content type. The codec passed to Subscribe is only
+// used for deliveries that carry no content type.
+func DecodeByContentType() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeByContentType = true
+	}
+}
+
+func Subscribe[T any](
+	ctx context.Context,
+	b Broker,
+	codec Codec,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, queueType, handler, func(data []byte) (T, error) {
-		var t T
-		buf := bytes.NewBuffer(data)
-		decoder := json.NewDecoder(buf)
-		if err := decoder.Decode(&t); err != nil {
-			return t, err
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := subscribeOptions{
+		prefetch:      defaultPrefetch,
+		workers:       1,
+		decodeFailure: decodeFailureDeadLetter,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	handler, err := applyMiddleware(handler, options.middleware)
+	if err != nil {
+		return nil, err
+	}
+	return subscribe(ctx, b, exchange, queueName, key, queueType, options, handler, func(msg amqp.Delivery) (T, error) {
+		msgCodec := codec
+		if options.decodeByContentType && msg.ContentType != "" {
+			var ok bool
+			msgCodec, ok = CodecFor(msg.ContentType)
+			if !ok {
+				var t T
+				return t, fmt.Errorf("no codec registered for content type '%s'", msg.ContentType)
+			}
 		}
-		return t, nil
+		body, err := decompress(msg.ContentEncoding, msg.Body)
+		if err != nil {
+			var t T
+			return t, fmt.Errorf("error decompressing message: %w", err)
+		}
+		return routing.DecodeSchema[T](schemaVersion(msg.Headers), func(v any) error {
+			return msgCodec.Unmarshal(body, v)
+		})
 	})
 }
 
-func SubscribeGob[T any](
-	conn *amqp.Connection,
+func subscribe[T any](
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, queueType, handler, func(data []byte) (T, error) {
-		var t T
-		buf := bytes.NewBuffer(data)
-		decoder := gob.NewDecoder(buf)
-		if err := decoder.Decode(&t); err != nil {
-			return t, err
+	options subscribeOptions,
+	handler Handler[T],
+	unmarshaller func(amqp.Delivery) (T, error),
+) (*Subscription, error) {
+	if options.verifier != nil && options.dedup == nil {
+		options.dedup = NewDeduplicator(0)
+	}
+	if options.retry != nil {
+		if err := declareRetryTopology(ctx, b, *options.retry); err != nil {
+			return nil, fmt.Errorf("error declaring retry queues: %s", err)
 		}
-		return t, nil
-	})
+	}
+	subLogger := options.logger
+	if subLogger == nil {
+		subLogger = logger()
+	}
+	c := &consumer[T]{
+		broker:       b,
+		exchange:     exchange,
+		queueName:    queueName,
+		bindingKey:   key,
+		log:          subLogger.With("queue", queueName),
+		options:      options,
+		handler:      handler,
+		unmarshaller: unmarshaller,
+	}
+	c.lastOffset.Store(-1)
+	ch, deliveryCh, err := consume(ctx, b, exchange, queueName, key, queueType, options.queueOptions, options.prefetch, c.consumeArgs())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	sub := &Subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(sub.done)
+		defer cancel(nil)
+		for {
+			c.run(ctx, deliveryCh)
+			ch.Close()
+			if ctx.Err() != nil {
+				if cause := context.Cause(ctx); !errors.Is(cause, errClosedByCaller) {
+					sub.err = cause
+				}
+				return
+			}
+			c.log.Warn("lost consumer, resubscribing")
+			ch, deliveryCh, err = reconsume(ctx, b, c.log, exchange, queueName, key, queueType, options.queueOptions, options.prefetch, c.consumeArgs())
+			if err != nil {
+				if !errors.Is(context.Cause(ctx), errClosedByCaller) {
+					sub.err = err
+				}
+				return
+			}
+		}
+	}()
+	return sub, nil
 }
 
-func subscribe[T any](
-	conn *amqp.Connection,
+func consume(
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, q, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	queueOpts []QueueOption,
+	prefetch int,
+	args amqp.Table,
+) (Channel, <-chan amqp.Delivery, error) {
+	ch, q, err := DeclareAndBind(ctx, b, exchange, queueName, key, queueType, queueOpts...)
 	if err != nil {
-		return fmt.Errorf("error declaring queue: %s", err)
+		return nil, nil, fmt.Errorf("error declaring queue: %w", err)
 	}
-	err = ch.Qos(10, 0, false)
+	err = ch.Qos(prefetch, 0, false)
 	if err != nil {
-		return fmt.Errorf("error setting up prefetch config: %s", err)
+		ch.Close()
+		return nil, nil, fmt.Errorf("error setting up prefetch config: %s", err)
 	}
-	deliveryCh, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	deliveryCh, err := ch.Consume(q.Name, "", false, false, false, false, args)
 	if err != nil {
-		return fmt.Errorf("error consuming queue: %s", err)
+		ch.Close()
+		return nil, nil, fmt.Errorf("error consuming queue: %s", err)
 	}
-	go func() {
-		for msg := range deliveryCh {
-			msgData, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("Error processing message data from queue %s: %s", q.Name, err)
-				continue
-			}
-			switch handler(msgData) {
-			case Ack:
-				log.Println("Acknowledging message...")
-				msg.Ack(false)
-			case NackRequeue:
-				log.Println("Requeuing message...")
-				msg.Nack(false, true)
-			case NackDiscard:
-				log.Println("Discarding message...")
-				msg.Nack(false, false)
-			}
+	return ch, deliveryCh, nil
+}
+
+// reconsume retries consume with backoff until it succeeds, ctx is done or
+// the connection is closed for good.
+func reconsume(
+	ctx context.Context,
+	b Broker,
+	logger *slog.Logger,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	queueOpts []QueueOption,
+	prefetch int,
+	args amqp.Table,
+) (Channel, <-chan amqp.Delivery, error) {
+	backoff := minReconnectBackoff
+	for {
+		ch, deliveryCh, err := consume(ctx, b, exchange, queueName, key, queueType, queueOpts, prefetch, args)
+		if err == nil {
+			return ch, deliveryCh, nil
+		}
+		if errors.Is(err, ErrConnectionClosed) {
+			return nil, nil, ErrConnectionClosed
+		}
+		logger.Warn("error resubscribing", "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, nil, context.Cause(ctx)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
+
+type consumer[T any] struct {
+	broker       Broker
+	exchange     string
+	queueName    string
+	bindingKey   string
+	log          *slog.Logger
+	options      subscribeOptions
+	handler      Handler[T]
+	unmarshaller func(amqp.Delivery) (T, error)
+	// lastOffset is the stream offset of the last delivery received from a
+	// stream, or -1.
+	lastOffset atomic.Int64
+}
+
+// run handles deliveries until ctx is done or deliveryCh is closed, then
+// waits for the workers to finish the deliveries they already picked up.
+func (c *consumer[T]) run(ctx context.Context, deliveryCh <-chan amqp.Delivery) {
+	lanes := make([]chan amqp.Delivery, 1)
+	workersPerLane := c.options.workers
+	if c.options.orderingKey != nil {
+		lanes = make([]chan amqp.Delivery, c.options.workers)
+		workersPerLane = 1
+	}
+	var wg sync.WaitGroup
+	for i := range lanes {
+		lanes[i] = make(chan amqp.Delivery)
+		for range workersPerLane {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for msg := range lanes[i] {
+					c.handle(ctx, msg)
+				}
+			}()
+		}
+	}
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
 		}
+		wg.Wait()
 	}()
-	return nil
+	for {
+		var msg amqp.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok = <-deliveryCh:
+		}
+		if !ok {
+			return
+		}
+		if _, ok := msg.Headers[streamOffsetArg]; ok {
+			c.lastOffset.Store(int64(headerInt(msg.Headers, streamOffsetArg)))
+		}
+		lane := lanes[0]
+		if c.options.orderingKey != nil {
+			h := fnv.New32a()
+			h.Write([]byte(c.options.orderingKey(msg)))
+			lane = lanes[h.Sum32()%uint32(len(lanes))]
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case lane <- msg:
+		}
+	}
+}
+
+func (c *consumer[T]) handle(ctx context.Context, msg amqp.Delivery) {
+	deliveriesTotal.WithLabelValues(c.queueName).Inc()
+	spanCtx, span := startProcessSpan(ctx, c.queueName, msg)
+	defer span.End()
+	if c.options.verifier != nil && !c.verify(spanCtx, msg) {
+		span.SetStatus(codes.Error, "signature not verified")
+		return
+	}
+	msgData, err := c.unmarshaller(msg)
+	if err != nil {
+		decodeFailuresTotal.WithLabelValues(c.queueName).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "decode failed")
+		c.log.Error("error decoding message", "message_id", msg.MessageId, "routing_key", msg.RoutingKey, "content_type", msg.ContentType, "error", err)
+		c.rejectUndecodable(ctx, msg, err)
+		return
+	}
+	dedupKey := ""
+	if c.options.dedup != nil && msg.MessageId != "" {
+		dedupKey = c.queueName + "/" + msg.MessageId
+		if !c.options.dedup.reserve(dedupKey) {
+			c.log.Info("skipping duplicate message", "message_id", msg.MessageId, "routing_key", msg.RoutingKey)
+			outcomesTotal.WithLabelValues(c.queueName, outcomeDuplicate).Inc()
+			span.SetAttributes(attribute.String("peril.outcome", outcomeDuplicate))
+			msg.Ack(false)
+			return
+		}
+	}
+	start := time.Now()
+	ack := c.handler(msgData, envelopeFromDelivery(spanCtx, msg))
+	observeHandled(c.queueName, ack, start)
+	span.SetAttributes(attribute.String("peril.outcome", ack.String()))
+	if ack == NackDiscard {
+		span.SetStatus(codes.Error, "message discarded")
+	}
+	if dedupKey != "" {
+		c.options.dedup.settle(dedupKey, ack)
+	}
+	switch ack {
+	case Ack:
+		msg.Ack(false)
+	case NackRequeue:
+		c.requeue(ctx, msg)
+	case NackDiscard:
+		msg.Nack(false, false)
+	}
+}
+
+// requeue schedules a retry of msg if the subscription has a retry policy,
+// and returns it to the queue otherwise.
+func (c *consumer[T]) requeue(ctx context.Context, msg amqp.Delivery) {
+	if c.options.retry != nil {
+		c.retry(ctx, msg)
+		return
+	}
+	msg.Nack(false, true)
 }
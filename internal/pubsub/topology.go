@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hyuko21/pubsub-golang/internal/routing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareDeadLetterTopology declares the exchange every queue from
+// DeclareAndBind dead-letters to, and the queue that collects those messages.
+func DeclareDeadLetterTopology(ctx context.Context, b Broker) error {
+	ch, err := b.Channel(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %s", err)
+	}
+	defer ch.Close()
+	if err := declareDeadLetterTopology(ch); err != nil {
+		return err
+	}
+	remember(b, "dead-letter topology", declareDeadLetterTopology)
+	return nil
+}
+
+func declareDeadLetterTopology(ch Channel) error {
+	err := ch.ExchangeDeclare(routing.ExchangePerilDLX, amqp.ExchangeFanout, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %s", routing.ExchangePerilDLX, err)
+	}
+	_, err = ch.QueueDeclare(routing.QueuePerilDLQ, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create queue %s: %s", routing.QueuePerilDLQ, err)
+	}
+	err = ch.QueueBind(routing.QueuePerilDLQ, "", routing.ExchangePerilDLX, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s: %s", routing.QueuePerilDLQ, err)
+	}
+	return nil
+}
+
+// ErrExchangeNotFound is returned by VerifyExchanges for exchanges the
+// broker does not have.
+var ErrExchangeNotFound = errors.New("exchange not found")
+
+// Exchange describes an exchange the game publishes to.
+type Exchange struct {
+	Name    string
+	Kind    string
+	Durable bool
+}
+
+// PerilExchanges are the exchanges game messages are routed through.
+var PerilExchanges = []Exchange{
+	{Name: routing.ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+	{Name: routing.ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+}
+
+// DeclareExchanges declares exchanges, leaving those that already exist as
+// they are. It fails if one exists with a different kind or durability.
+func DeclareExchanges(ctx context.Context, b Broker, exchanges ...Exchange) error {
+	ch, err := b.Channel(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create channel: %s", err)
+	}
+	defer ch.Close()
+	for _, ex := range exchanges {
+		declare := func(ch Channel) error {
+			return declareExchange(ch, ex)
+		}
+		if err := declare(ch); err != nil {
+			return err
+		}
+		remember(b, "exchange "+ex.Name, declare)
+	}
+	return nil
+}
+
+func declareExchange(ch Channel, ex Exchange) error {
+	err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %s", ex.Name, err)
+	}
+	return nil
+}
+
+// VerifyExchanges checks that exchanges exist without declaring them, for
+// processes that should not create topology of their own. The broker closes
+// a channel on which a passive declaration fails, so each exchange is
+// checked on a channel of its own.
+func VerifyExchanges(ctx context.Context, b Broker, exchanges ...Exchange) error {
+	for _, ex := range exchanges {
+		ch, err := b.Channel(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create channel: %s", err)
+		}
+		err = ch.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, false, false, false, nil)
+		ch.Close()
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return fmt.Errorf("%w: '%s'", ErrExchangeNotFound, ex.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to verify exchange %s: %s", ex.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const tracerName = "github.com/hyuko21/pubsub-golang/internal/pubsub"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// headerCarrier lets the global propagator read and write trace context in
+// message headers.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+var _ propagation.TextMapCarrier = headerCarrier{}
+
+// instrumentPublish starts a producer span for msg and writes its context to
+// msg's headers. The span is a child of the trace context already in the
+// headers, if CausedBy put one there, and of ctx otherwise. The returned
+// function ends the span and counts the publish.
+func instrumentPublish(ctx context.Context, exchange, key string, msg *amqp.Publishing) func(error) {
+	carrier := headerCarrier(msg.Headers)
+	if carrier.Get("traceparent") != "" {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	}
+	ctx, span := tracer().Start(ctx, fmt.Sprintf("publish %s", exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation.type", "send"),
+			attribute.String("messaging.destination.name", exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", key),
+			attribute.String("messaging.message.id", msg.MessageId),
+			attribute.String("messaging.message.conversation_id", msg.CorrelationId),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		observePublish(exchange, key, err)
+	}
+}
+
+// startProcessSpan starts a consumer span for msg that continues the trace
+// it was published in.
+func startProcessSpan(ctx context.Context, queueName string, msg amqp.Delivery) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(msg.Headers))
+	return tracer().Start(ctx, fmt.Sprintf("process %s", queueName),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation.type", "process"),
+			attribute.String("messaging.destination.name", msg.Exchange),
+			attribute.String("messaging.destination.subscription.name", queueName),
+			attribute.String("messaging.rabbitmq.destination.routing_key", msg.RoutingKey),
+			attribute.String("messaging.message.id", msg.MessageId),
+			attribute.String("messaging.message.conversation_id", msg.CorrelationId),
+		),
+	)
+}
@@ -6,6 +6,24 @@ type PlayingState struct {
 	IsPaused bool
 }
 
+type GameStateRequest struct {
+	Username string
+}
+
+// SigningKeyRequest asks for a certificate binding Username to PublicKey,
+// the public half of a key pair only its player holds. The first request for
+// a username claims it, and later requests must present the same key.
+type SigningKeyRequest struct {
+	Username  string
+	PublicKey []byte
+}
+
+// SigningCertificate is the authority's signature over the username and
+// public key of a SigningKeyRequest.
+type SigningCertificate struct {
+	Signature []byte
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
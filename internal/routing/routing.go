@@ -8,9 +8,22 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	GameStateKey = "game_state"
+
+	SigningKeyKey = "signing_key"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
+
+	// Each retry delay gets its own exchange and queue, named
+	// "<RetryPrefix>.<delay>".
+	RetryPrefix = "peril_retry"
+)
+
+const (
+	QueuePerilDLQ = "peril_dlq"
 )
@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// schema records the current version of a message type and how to upcast
+// each older version to the next one.
+type schema struct {
+	current int
+	steps   map[int]upcastStep
+}
+
+type upcastStep struct {
+	from   reflect.Type
+	upcast func(any) (any, error)
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[reflect.Type]*schema{}
+)
+
+func init() {
+	RegisterSchema[PlayingState](1)
+	RegisterSchema[GameLog](1)
+	RegisterSchema[GameStateRequest](1)
+	RegisterSchema[SigningKeyRequest](1)
+	RegisterSchema[SigningCertificate](1)
+}
+
+func schemaFor(t reflect.Type) *schema {
+	s, ok := schemas[t]
+	if !ok {
+		s = &schema{current: 1, steps: map[int]upcastStep{}}
+		schemas[t] = s
+	}
+	return s
+}
+
+// RegisterSchema declares version as the current schema version of T.
+// Messages of a registered type are published with their version, and
+// older versions are upcast to T when they are received. Bump a version, and
+// register an upcaster from the previous one, whenever a change to the type
+// would make older payloads decode wrongly.
+func RegisterSchema[T any](version int) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemaFor(reflect.TypeFor[T]()).current = version
+}
+
+// RegisterUpcaster teaches T's schema to turn a payload of version from,
+// decoded as From, into version from+1, which is To. The last upcaster of
+// a chain has T as its To.
+func RegisterUpcaster[T, From, To any](from int, upcast func(From) (To, error)) {
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemaFor(reflect.TypeFor[T]()).steps[from] = upcastStep{
+		from: reflect.TypeFor[From](),
+		upcast: func(v any) (any, error) {
+			from, ok := v.(From)
+			if !ok {
+				return nil, fmt.Errorf("upcaster expects a %T, got a %T", from, v)
+			}
+			return upcast(from)
+		},
+	}
+}
+
+// SchemaVersion returns the current schema version of v's type, if it is
+// registered.
+func SchemaVersion(v any) (int, bool) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	s, ok := schemas[reflect.TypeOf(v)]
+	if !ok {
+		return 0, false
+	}
+	return s.current, true
+}
+
+// DecodeSchema decodes a payload written with the given version of T's
+// schema into a T. decode unmarshals the payload into the pointer it is
+// given. Older versions are decoded as the type their first upcaster
+// expects and upcast one version at a time. Payloads of unregistered types,
+// and of versions newer than T's, are decoded into T directly so that
+// readers tolerate fields they do not know about yet.
+func DecodeSchema[T any](version int, decode func(any) error) (T, error) {
+	var t T
+	schemasMu.RLock()
+	s := schemas[reflect.TypeFor[T]()]
+	var steps []upcastStep
+	if s != nil {
+		for v := version; v < s.current; v++ {
+			step, ok := s.steps[v]
+			if !ok {
+				schemasMu.RUnlock()
+				return t, fmt.Errorf("no upcaster from version %d of %T", v, t)
+			}
+			steps = append(steps, step)
+		}
+	}
+	schemasMu.RUnlock()
+
+	if len(steps) == 0 {
+		err := decode(&t)
+		return t, err
+	}
+	old := reflect.New(steps[0].from)
+	if err := decode(old.Interface()); err != nil {
+		return t, err
+	}
+	val := old.Elem().Interface()
+	for i, step := range steps {
+		var err error
+		val, err = step.upcast(val)
+		if err != nil {
+			return t, fmt.Errorf("error upcasting version %d of %T: %w", version+i, t, err)
+		}
+	}
+	t, ok := val.(T)
+	if !ok {
+		return t, fmt.Errorf("upcasting version %d of %T produced a %T", version, t, val)
+	}
+	return t, nil
+}
@@ -2,11 +2,13 @@
 
 # Check if the number of instances was provided
 if [ -z "$1" ]; then
-  echo "Usage: $0 <number-of-instances>"
+  echo "Usage: $0 <number-of-instances> [server flags...]"
+  echo "Example: $0 3 -log-format json"
   exit 1
 fi
 
 num_instances=$1
+shift
 
 # Array to store process IDs
 declare -a pids
@@ -23,9 +25,10 @@ cleanup() {
 # Setup trap for SIGINT
 trap 'cleanup' SIGINT
 
-# Start the specified number of instances of the program in the background
+# Start the specified number of instances of the program in the background,
+# each with its own dedup store
 for (( i=0; i<num_instances; i++ )); do
-  go run ./cmd/server &
+  go run ./cmd/server -dedup-store "game_logs.$i.dedup" "$@" &
   pids+=($!)
 done
 